@@ -0,0 +1,898 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCattleHome = "/var/lib/cattle"
+	defaultBinDir     = "/usr/local/bin"
+	defaultMachineCmd = "docker-machine"
+
+	MachineBackendCLI    = "cli"
+	MachineBackendNative = "native"
+
+	AgentBootstrapAuto = "auto"
+	AgentBootstrapTLS  = "tls"
+	AgentBootstrapSSH  = "ssh"
+
+	AgentIPPublic  = "public"
+	AgentIPPrivate = "private"
+
+	TracingExporterFile = "file"
+	TracingExporterOTLP = "otlp"
+
+	PhaseMachineCreate     = "machineCreate"
+	PhaseSaveConfig        = "saveConfig"
+	PhasePostCreateHooks   = "postCreateHooks"
+	PhaseAgentContainer    = "agentContainer"
+	PhaseAgentRegistration = "agentRegistration"
+	PhaseImagePrePull      = "imagePrePull"
+)
+
+// Config is the configuration of the service. Values are resolved in this order,
+// each step overriding the previous one:
+//
+//  1. the defaults returned by Default
+//  2. the JSON or YAML file given by -config or GMS_CONFIG
+//  3. environment variables, such as CATTLE_URL or GMS_BIN_DIR
+//  4. command line flags
+type Config struct {
+	ConfigFile  string `json:"-"`
+	ShowVersion bool   `json:"-"`
+
+	CattleURL       string `json:"cattleUrl"`
+	CattleAccessKey string `json:"cattleAccessKey"`
+	CattleSecretKey string `json:"cattleSecretKey"`
+	// CattleHome holds the machine driver cache and, unless MachineWorkDir is set, the machine dirs.
+	CattleHome     string `json:"cattleHome"`
+	MachineWorkDir string `json:"machineWorkDir"`
+	// BinDir is where machine driver binaries are installed.
+	BinDir string `json:"binDir"`
+	// DockerMachine is the docker-machine binary to run.
+	DockerMachine string `json:"dockerMachine"`
+	// MachineBackend is "cli" to inspect and remove machines with docker-machine,
+	// or "native" to do it in process, falling back to docker-machine for the
+	// machines it can't handle. Machines are always created with docker-machine.
+	MachineBackend string `json:"machineBackend"`
+	// AgentBootstrap is how the agent container is started on new machines:
+	// "tls" through the docker API of the machine, "ssh" with the docker CLI
+	// over docker-machine ssh, or "auto" to use ssh when the docker API can't
+	// be reached. Host templates override it with a label.
+	AgentBootstrap string `json:"agentBootstrap"`
+	// AgentIPPolicy is how the IP the agent registers with is picked among
+	// the addresses of new machines: "public", "private" or the first in a
+	// CIDR such as 10.0.0.0/8. Empty leaves the agent to detect it. Host
+	// templates override it with their agentIpPolicy value.
+	AgentIPPolicy string `json:"agentIpPolicy"`
+	// ImageRewrites rewrite the references of the agent and system images
+	// pulled on machines, such as to a registry mirror. The first match wins.
+	ImageRewrites []ImageRewrite `json:"imageRewrites"`
+	// Proxy is the HTTP proxy of driver downloads, machine engines and agents.
+	// Host templates override it with their httpProxy, httpsProxy and noProxy values.
+	Proxy Proxy `json:"proxy"`
+	// AgentLocalhostReplace replaces localhost in the registration URL given to the agent.
+	AgentLocalhostReplace string `json:"agentLocalhostReplace"`
+	DockerTLSVerify       bool   `json:"dockerTlsVerify"`
+
+	LogLevel string `json:"logLevel"`
+	// ListenAddress is the address of the status and provisioning log
+	// endpoints. It is local by default, as the provisioning logs may hold
+	// driver credentials the redaction misses and the endpoints are not
+	// authenticated.
+	ListenAddress string `json:"listenAddress"`
+	// ProbeAddress is the address of the health, readiness and metrics
+	// endpoints, which probes reach from outside.
+	ProbeAddress string   `json:"probeAddress"`
+	DrainTimeout Duration `json:"drainTimeout"`
+
+	Admission     Admission     `json:"admission"`
+	Leases        Leases        `json:"leases"`
+	Reconcile     Reconcile     `json:"reconcile"`
+	Tracing       Tracing       `json:"tracing"`
+	Provisioning  Provisioning  `json:"provisioning"`
+	ProvisionLogs ProvisionLogs `json:"provisionLogs"`
+	ImagePrePull  ImagePrePull  `json:"imagePrePull"`
+}
+
+// ValidateAgentIPPolicy returns an error if policy is not a valid agent IP policy.
+func ValidateAgentIPPolicy(policy string) error {
+	switch policy {
+	case "", AgentIPPublic, AgentIPPrivate:
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(policy); err != nil {
+		return errors.Errorf("invalid agentIpPolicy %q", policy)
+	}
+	return nil
+}
+
+// ImageRewrite replaces From with To in the fully qualified image references
+// it matches. A From ending with * matches the references starting with the
+// rest of it, such as docker.io/rancher/* -> registry.internal/rancher/*,
+// otherwise it matches the repository name exactly and keeps the tag.
+type ImageRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (r ImageRewrite) validate() error {
+	if r.From == "" || r.To == "" || r.From == "*" {
+		return errors.Errorf("invalid image rewrite %q -> %q", r.From, r.To)
+	}
+	if strings.HasSuffix(r.From, "*") != strings.HasSuffix(r.To, "*") ||
+		strings.Count(r.From, "*") > 1 || strings.Count(r.To, "*") > 1 {
+		return errors.Errorf("invalid image rewrite %q -> %q, * may only end both", r.From, r.To)
+	}
+	return nil
+}
+
+// Proxy is an HTTP proxy configuration, given to the processes using it as
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+type Proxy struct {
+	HTTPProxy  string `json:"httpProxy"`
+	HTTPSProxy string `json:"httpsProxy"`
+	// NoProxy is a comma separated list of hosts or domains, such as
+	// .example.com, reached without the proxy.
+	NoProxy string `json:"noProxy"`
+}
+
+// Enabled returns whether a proxy is set.
+func (p Proxy) Enabled() bool {
+	return p.HTTPProxy != "" || p.HTTPSProxy != ""
+}
+
+// WithNoProxy returns the proxy with the hosts added to NoProxy, unless already there.
+func (p Proxy) WithNoProxy(hosts ...string) Proxy {
+	entries := []string{}
+	seen := map[string]bool{}
+	for _, entry := range append(strings.Split(p.NoProxy, ","), hosts...) {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	p.NoProxy = strings.Join(entries, ",")
+	return p
+}
+
+// Env returns the environment variables of the proxy, in both cases as tools
+// such as curl only read the lower case ones. It is empty if no proxy is set.
+func (p Proxy) Env() []string {
+	if !p.Enabled() {
+		return nil
+	}
+	env := []string{}
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", p.HTTPProxy},
+		{"HTTPS_PROXY", p.HTTPSProxy},
+		{"NO_PROXY", p.NoProxy},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value, strings.ToLower(v.name)+"="+v.value)
+		}
+	}
+	return env
+}
+
+// ProxyURL returns the proxy URL of the request, or nil if it is sent
+// directly. It can be used as the Proxy of an http.Transport.
+func (p Proxy) ProxyURL(req *http.Request) (*url.URL, error) {
+	proxy := p.HTTPProxy
+	if req.URL.Scheme == "https" {
+		proxy = p.HTTPSProxy
+	}
+	if proxy == "" || p.bypass(Hostname(req.URL)) {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// bypass returns whether the host matches NoProxy.
+func (p Proxy) bypass(host string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(p.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if entry != "" && (host == entry || strings.HasSuffix(host, "."+entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hostname returns the host of the URL without its port or the brackets of
+// an IPv6 address.
+func Hostname(u *url.URL) string {
+	host := u.Host
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "]"); i >= 0 {
+			return host[1:i]
+		}
+		return host[1:]
+	}
+	if i := strings.Index(host, ":"); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// Limit bounds the docker-machine creates that run against one driver or host template.
+type Limit struct {
+	// MaxConcurrent is the maximum number of creates running at once, 0 means unlimited.
+	MaxConcurrent int `json:"maxConcurrent"`
+	// Rate is the number of creates started per second, 0 means unlimited.
+	Rate float64 `json:"rate"`
+	// Burst is the number of creates that can be started at once when the rate allows it.
+	Burst int `json:"burst"`
+}
+
+type Admission struct {
+	Default Limit            `json:"default"`
+	Drivers map[string]Limit `json:"drivers"`
+	// PerHostTemplate also limits the creates of each host template, with the
+	// limit of its driver, on top of the limit of the driver they share.
+	PerHostTemplate bool `json:"perHostTemplate"`
+}
+
+// Leases control host ownership when several instances of the service run at once.
+type Leases struct {
+	Enabled    bool     `json:"enabled"`
+	InstanceID string   `json:"instanceId"`
+	Duration   Duration `json:"duration"`
+}
+
+// Reconcile controls the background loop that repairs machine drivers and finds stuck hosts.
+type Reconcile struct {
+	// Interval between reconciliations, 0 disables the loop.
+	Interval Duration `json:"interval"`
+	// StuckHostTimeout is how long a host may be provisioning without a handler before it is reported.
+	StuckHostTimeout Duration `json:"stuckHostTimeout"`
+	// RetryStuckHosts restarts the provisioning of stuck hosts instead of only reporting them.
+	RetryStuckHosts bool `json:"retryStuckHosts"`
+}
+
+// Tracing selects where the trace spans of event handling are exported.
+type Tracing struct {
+	// Exporter is "file", "otlp" or empty to disable tracing.
+	Exporter string `json:"exporter"`
+	// File receives the spans as JSON lines when the exporter is "file".
+	File string `json:"file"`
+	// Endpoint is the OTLP/HTTP traces URL when the exporter is "otlp".
+	Endpoint string `json:"endpoint"`
+}
+
+// Phase is the timeout and retry policy of a provisioning phase.
+type Phase struct {
+	// Timeout bounds the phase, retries included, 0 means no timeout.
+	Timeout Duration `json:"timeout"`
+	// Attempts is the maximum number of times the phase is tried.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait between two attempts.
+	Backoff Duration `json:"backoff"`
+}
+
+// Provisioning holds the policies of the phases of a host provisioning. Host
+// templates override them with labels, see ParsePhase.
+type Provisioning struct {
+	// MachineCreate is docker-machine create, which is cleaned up before it is retried.
+	MachineCreate Phase `json:"machineCreate"`
+	// SaveConfig is the upload of the machine config to the host.
+	SaveConfig Phase `json:"saveConfig"`
+	// PostCreateHooks is each run of a post-create script on the machine.
+	PostCreateHooks Phase `json:"postCreateHooks"`
+	// AgentContainer is the wait for the agent container to run on the machine.
+	AgentContainer Phase `json:"agentContainer"`
+	// AgentRegistration is the wait for the agent to register the host.
+	AgentRegistration Phase `json:"agentRegistration"`
+	// ImagePrePull is the pull of each system image once the agent runs.
+	ImagePrePull Phase `json:"imagePrePull"`
+}
+
+func (p *Provisioning) phases() map[string]*Phase {
+	return map[string]*Phase{
+		PhaseMachineCreate:     &p.MachineCreate,
+		PhaseSaveConfig:        &p.SaveConfig,
+		PhasePostCreateHooks:   &p.PostCreateHooks,
+		PhaseAgentContainer:    &p.AgentContainer,
+		PhaseAgentRegistration: &p.AgentRegistration,
+		PhaseImagePrePull:      &p.ImagePrePull,
+	}
+}
+
+// Phase returns the policy of the named phase.
+func (p Provisioning) Phase(name string) (Phase, bool) {
+	phase, ok := p.phases()[name]
+	if !ok {
+		return Phase{}, false
+	}
+	return *phase, true
+}
+
+// ProvisionLogs controls the transcripts of docker-machine create kept for each host.
+type ProvisionLogs struct {
+	// MaxSize is the size in bytes a transcript may reach before it is rotated.
+	MaxSize int64 `json:"maxSize"`
+	// MaxFiles is the number of transcripts kept per host, the current one included.
+	MaxFiles int `json:"maxFiles"`
+	// MaxAge is how long transcripts are kept after their last write, 0 keeps them forever.
+	MaxAge Duration `json:"maxAge"`
+}
+
+// ImagePrePull controls the pulls of the system images on new machines, which
+// run in the background once the agent is started.
+type ImagePrePull struct {
+	// Workers is the number of images pulled at once per host, 0 disables the pre-pull.
+	Workers int `json:"workers"`
+}
+
+func Default() *Config {
+	return &Config{
+		CattleHome:     defaultCattleHome,
+		BinDir:         defaultBinDir,
+		DockerMachine:  defaultMachineCmd,
+		MachineBackend: MachineBackendCLI,
+		AgentBootstrap: AgentBootstrapAuto,
+		LogLevel:       "debug",
+		ListenAddress:  "127.0.0.1:8114",
+		ProbeAddress:   ":8113",
+		DrainTimeout:   Duration{5 * time.Minute},
+		Admission: Admission{
+			Drivers: map[string]Limit{},
+		},
+		Leases: Leases{
+			InstanceID: defaultInstanceID(),
+			Duration:   Duration{time.Minute},
+		},
+		Reconcile: Reconcile{
+			Interval:         Duration{5 * time.Minute},
+			StuckHostTimeout: Duration{30 * time.Minute},
+		},
+		Provisioning: Provisioning{
+			MachineCreate:     Phase{Timeout: Duration{time.Hour}, Attempts: 1},
+			SaveConfig:        Phase{Timeout: Duration{2 * time.Minute}, Attempts: 10, Backoff: Duration{time.Second}},
+			PostCreateHooks:   Phase{Timeout: Duration{30 * time.Minute}, Attempts: 1},
+			AgentContainer:    Phase{Attempts: 30, Backoff: Duration{2 * time.Second}},
+			AgentRegistration: Phase{Attempts: 150, Backoff: Duration{2 * time.Second}},
+			ImagePrePull:      Phase{Timeout: Duration{20 * time.Minute}, Attempts: 3, Backoff: Duration{10 * time.Second}},
+		},
+		ProvisionLogs: ProvisionLogs{
+			MaxSize:  1 << 20,
+			MaxFiles: 3,
+			MaxAge:   Duration{7 * 24 * time.Hour},
+		},
+		ImagePrePull: ImagePrePull{
+			Workers: 3,
+		},
+	}
+}
+
+// Load resolves the configuration from the command line arguments, the config
+// file and the environment, and validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	// The config file is needed before the flags can be applied on top of it
+	scratch := Default()
+	scratch.ConfigFile = getenv("GMS_CONFIG")
+	fs := flag.NewFlagSet("go-machine-service", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	scratch.bindFlags(fs)
+	// Errors are reported by the second parse below
+	fs.Parse(args)
+
+	c := Default()
+	c.ConfigFile = scratch.ConfigFile
+	if c.ConfigFile != "" {
+		if err := c.loadFile(c.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	c.loadEnv(getenv)
+
+	fs = flag.NewFlagSet("go-machine-service", flag.ContinueOnError)
+	c.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// loadFile reads the config file, as YAML if its extension is .yaml or .yml
+// and as JSON otherwise. Both use the json names of the fields.
+func (c *Config) loadFile(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if content, err = yaml.YAMLToJSON(content); err != nil {
+			return errors.Wrapf(err, "Reading config file %s", file)
+		}
+	}
+
+	if err := json.Unmarshal(content, c); err != nil {
+		return errors.Wrapf(err, "Reading config file %s", file)
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return errors.Wrapf(err, "Reading config file %s", file)
+	}
+	known, err := toMap(c)
+	if err != nil {
+		return err
+	}
+	if field := unknownField(raw, known, ""); field != "" {
+		return errors.Errorf("Reading config file %s: unknown field %q", file, field)
+	}
+	return nil
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	return m, json.Unmarshal(content, &m)
+}
+
+// unknownField returns the first field of raw, the object read from the
+// config file, that known, the config it was read into, does not have. Names
+// match regardless of case, as they do when decoding.
+func unknownField(raw, known map[string]interface{}, prefix string) string {
+	lower := map[string]interface{}{}
+	for key, value := range known {
+		lower[strings.ToLower(key)] = value
+	}
+	keys := []string{}
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		knownValue, ok := lower[strings.ToLower(key)]
+		if !ok {
+			return prefix + key
+		}
+		rawObject, isObject := raw[key].(map[string]interface{})
+		knownObject, _ := knownValue.(map[string]interface{})
+		if isObject && knownObject != nil {
+			if field := unknownField(rawObject, knownObject, prefix+key+"."); field != "" {
+				return field
+			}
+		}
+		rawList, isList := raw[key].([]interface{})
+		knownList, _ := knownValue.([]interface{})
+		if isList && len(rawList) == len(knownList) {
+			for i := range rawList {
+				rawObject, _ := rawList[i].(map[string]interface{})
+				knownObject, _ := knownList[i].(map[string]interface{})
+				if rawObject != nil && knownObject != nil {
+					if field := unknownField(rawObject, knownObject, fmt.Sprintf("%s%s[%d].", prefix, key, i)); field != "" {
+						return field
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (c *Config) loadEnv(getenv func(string) string) {
+	for env, value := range map[string]*string{
+		"CATTLE_URL":                     &c.CattleURL,
+		"CATTLE_ACCESS_KEY":              &c.CattleAccessKey,
+		"CATTLE_SECRET_KEY":              &c.CattleSecretKey,
+		"CATTLE_HOME":                    &c.CattleHome,
+		"MACHINE_WORK_DIR":               &c.MachineWorkDir,
+		"GMS_BIN_DIR":                    &c.BinDir,
+		"CATTLE_AGENT_LOCALHOST_REPLACE": &c.AgentLocalhostReplace,
+	} {
+		if v := getenv(env); v != "" {
+			*value = v
+		}
+	}
+	if getenv("DOCKER_TLS_VERIFY") != "" {
+		c.DockerTLSVerify = true
+	}
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "path of a JSON or YAML config file")
+	fs.BoolVar(&c.ShowVersion, "v", c.ShowVersion, "read the version of the go-machine-service")
+
+	fs.StringVar(&c.CattleURL, "cattle-url", c.CattleURL, "URL of the Cattle API")
+	fs.StringVar(&c.CattleAccessKey, "cattle-access-key", c.CattleAccessKey, "access key of the Cattle API")
+	fs.StringVar(&c.CattleSecretKey, "cattle-secret-key", c.CattleSecretKey, "secret key of the Cattle API")
+	fs.StringVar(&c.CattleHome, "cattle-home", c.CattleHome, "directory of the machine driver cache")
+	fs.StringVar(&c.MachineWorkDir, "machine-work-dir", c.MachineWorkDir, "directory of the machine dirs, defaults to the cattle home")
+	fs.StringVar(&c.BinDir, "bin-dir", c.BinDir, "directory machine drivers are installed into")
+	fs.StringVar(&c.DockerMachine, "docker-machine", c.DockerMachine, "docker-machine binary to run")
+	fs.StringVar(&c.MachineBackend, "machine-backend", c.MachineBackend, "how machines are inspected and removed: cli or native")
+	fs.StringVar(&c.AgentBootstrap, "agent-bootstrap", c.AgentBootstrap, "how the agent is started on new machines: tls, ssh or auto")
+	fs.StringVar(&c.AgentIPPolicy, "agent-ip-policy", c.AgentIPPolicy, "IP new agents register with: public, private, a CIDR or empty to let the agent detect it")
+	fs.Var((*rewritesFlag)(&c.ImageRewrites), "image-rewrites", "image reference rewrites, as from=to,... such as docker.io/rancher/*=registry.internal/rancher/*")
+	fs.StringVar(&c.Proxy.HTTPProxy, "http-proxy", c.Proxy.HTTPProxy, "HTTP proxy of driver downloads, machine engines and agents")
+	fs.StringVar(&c.Proxy.HTTPSProxy, "https-proxy", c.Proxy.HTTPSProxy, "HTTPS proxy of driver downloads, machine engines and agents")
+	fs.StringVar(&c.Proxy.NoProxy, "no-proxy", c.Proxy.NoProxy, "comma separated hosts reached without the proxy, the Cattle host is added")
+	fs.StringVar(&c.AgentLocalhostReplace, "agent-localhost-replace", c.AgentLocalhostReplace, "replacement for localhost in the agent registration URL")
+	fs.BoolVar(&c.DockerTLSVerify, "docker-tls-verify", c.DockerTLSVerify, "verify the TLS certificate of the machine's docker engine")
+
+	fs.StringVar(&c.LogLevel, "loglevel", c.LogLevel, "log level: debug, info, warning or error")
+	fs.StringVar(&c.ListenAddress, "listen-address", c.ListenAddress, "address of the status and provisioning log endpoints, which are not authenticated")
+	fs.StringVar(&c.ProbeAddress, "probe-address", c.ProbeAddress, "address of the health, readiness and metrics endpoints")
+	fs.DurationVar(&c.DrainTimeout.Duration, "drain-timeout", c.DrainTimeout.Duration, "time to wait for running handlers on shutdown")
+
+	fs.IntVar(&c.Admission.Default.MaxConcurrent, "create-max-concurrent", c.Admission.Default.MaxConcurrent, "maximum concurrent machine creates per driver, 0 for unlimited")
+	fs.Float64Var(&c.Admission.Default.Rate, "create-rate", c.Admission.Default.Rate, "machine creates started per second per driver, 0 for unlimited")
+	fs.IntVar(&c.Admission.Default.Burst, "create-burst", c.Admission.Default.Burst, "machine creates that may start at once within the create rate")
+	fs.BoolVar(&c.Admission.PerHostTemplate, "create-limit-per-template", c.Admission.PerHostTemplate, "also apply create limits per host template, on top of those of their driver")
+	fs.Var((*limitsFlag)(&c.Admission.Drivers), "create-driver-limits", "per driver create limits, as driver=maxConcurrent[:rate[:burst]],...")
+
+	fs.BoolVar(&c.Leases.Enabled, "ha", c.Leases.Enabled, "claim hosts with leases so that several instances can run at once")
+	fs.StringVar(&c.Leases.InstanceID, "instance-id", c.Leases.InstanceID, "identity of this instance in host leases")
+	fs.DurationVar(&c.Leases.Duration.Duration, "lease-duration", c.Leases.Duration.Duration, "duration of host leases, renewed while a host is handled")
+
+	fs.DurationVar(&c.Reconcile.Interval.Duration, "reconcile-interval", c.Reconcile.Interval.Duration, "interval between driver and stuck host reconciliations, 0 to disable")
+	fs.DurationVar(&c.Reconcile.StuckHostTimeout.Duration, "stuck-host-timeout", c.Reconcile.StuckHostTimeout.Duration, "time a host may provision without a handler before it is considered stuck")
+	fs.BoolVar(&c.Reconcile.RetryStuckHosts, "retry-stuck-hosts", c.Reconcile.RetryStuckHosts, "restart the provisioning of stuck hosts instead of only reporting them")
+
+	fs.StringVar(&c.Tracing.Exporter, "tracing-exporter", c.Tracing.Exporter, "trace span exporter: file, otlp or empty to disable tracing")
+	fs.StringVar(&c.Tracing.File, "tracing-file", c.Tracing.File, "file the file exporter writes spans to")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "OTLP/HTTP traces URL, such as http://localhost:4318/v1/traces")
+
+	fs.Var((*phasesFlag)(&c.Provisioning), "provision-phases", "provisioning phase policies, as phase=timeout[:attempts[:backoff]],...")
+
+	fs.Int64Var(&c.ProvisionLogs.MaxSize, "provision-log-max-size", c.ProvisionLogs.MaxSize, "size in bytes at which a host's provisioning log is rotated")
+	fs.IntVar(&c.ProvisionLogs.MaxFiles, "provision-log-max-files", c.ProvisionLogs.MaxFiles, "provisioning log files kept per host")
+	fs.DurationVar(&c.ProvisionLogs.MaxAge.Duration, "provision-log-max-age", c.ProvisionLogs.MaxAge.Duration, "time provisioning logs are kept after their last write, 0 to keep them")
+
+	fs.IntVar(&c.ImagePrePull.Workers, "image-prepull-workers", c.ImagePrePull.Workers, "system images pulled at once per new host, 0 to disable the pre-pull")
+}
+
+func (c *Config) Validate() error {
+	if c.CattleURL == "" {
+		return errors.New("cattleUrl is required")
+	}
+	if u, err := url.Parse(c.CattleURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.Errorf("invalid cattleUrl %q", c.CattleURL)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return errors.Errorf("invalid logLevel %q", c.LogLevel)
+	}
+	if c.CattleHome == "" {
+		return errors.New("cattleHome is required")
+	}
+	if c.BinDir == "" {
+		return errors.New("binDir is required")
+	}
+	if c.DockerMachine == "" {
+		return errors.New("dockerMachine is required")
+	}
+	if c.MachineBackend != MachineBackendCLI && c.MachineBackend != MachineBackendNative {
+		return errors.Errorf("invalid machineBackend %q", c.MachineBackend)
+	}
+	switch c.AgentBootstrap {
+	case AgentBootstrapAuto, AgentBootstrapTLS, AgentBootstrapSSH:
+	default:
+		return errors.Errorf("invalid agentBootstrap %q", c.AgentBootstrap)
+	}
+	if err := ValidateAgentIPPolicy(c.AgentIPPolicy); err != nil {
+		return err
+	}
+	for _, rewrite := range c.ImageRewrites {
+		if err := rewrite.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ListenAddress == "" {
+		return errors.New("listenAddress is required")
+	}
+	if c.ProbeAddress == "" {
+		return errors.New("probeAddress is required")
+	}
+	if c.DrainTimeout.Duration < 0 {
+		return errors.Errorf("invalid drainTimeout %v", c.DrainTimeout)
+	}
+	if err := c.Admission.Default.validate("default"); err != nil {
+		return err
+	}
+	for driver, limit := range c.Admission.Drivers {
+		if err := limit.validate(driver); err != nil {
+			return err
+		}
+	}
+	if c.Leases.Enabled {
+		if c.Leases.InstanceID == "" {
+			return errors.New("leases.instanceId is required when leases are enabled")
+		}
+		if c.Leases.Duration.Duration <= 0 {
+			return errors.Errorf("invalid leases.duration %v", c.Leases.Duration)
+		}
+	}
+	if c.Reconcile.Interval.Duration < 0 {
+		return errors.Errorf("invalid reconcile.interval %v", c.Reconcile.Interval)
+	}
+	if c.Reconcile.StuckHostTimeout.Duration <= 0 {
+		return errors.Errorf("invalid reconcile.stuckHostTimeout %v", c.Reconcile.StuckHostTimeout)
+	}
+	switch c.Tracing.Exporter {
+	case "":
+	case TracingExporterFile:
+		if c.Tracing.File == "" {
+			return errors.New("tracing.file is required by the file exporter")
+		}
+	case TracingExporterOTLP:
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid tracing.endpoint %q", c.Tracing.Endpoint)
+		}
+	default:
+		return errors.Errorf("invalid tracing.exporter %q", c.Tracing.Exporter)
+	}
+	if c.ProvisionLogs.MaxSize <= 0 {
+		return errors.Errorf("invalid provisionLogs.maxSize %d", c.ProvisionLogs.MaxSize)
+	}
+	if c.ProvisionLogs.MaxFiles < 1 {
+		return errors.Errorf("invalid provisionLogs.maxFiles %d", c.ProvisionLogs.MaxFiles)
+	}
+	if c.ProvisionLogs.MaxAge.Duration < 0 {
+		return errors.Errorf("invalid provisionLogs.maxAge %v", c.ProvisionLogs.MaxAge)
+	}
+	if c.ImagePrePull.Workers < 0 {
+		return errors.Errorf("invalid imagePrePull.workers %d", c.ImagePrePull.Workers)
+	}
+	for name, phase := range c.Provisioning.phases() {
+		if err := phase.validate(); err != nil {
+			return errors.Wrapf(err, "invalid provisioning.%s", name)
+		}
+	}
+	return nil
+}
+
+// validate checks that the phase is tried at least once and has no negative durations.
+func (p Phase) validate() error {
+	if p.Attempts < 1 {
+		return errors.Errorf("attempts must be at least 1, got %d", p.Attempts)
+	}
+	if p.Timeout.Duration < 0 || p.Backoff.Duration < 0 {
+		return errors.New("durations must not be negative")
+	}
+	return nil
+}
+
+func (l Limit) validate(name string) error {
+	if l.MaxConcurrent < 0 || l.Rate < 0 || l.Burst < 0 {
+		return errors.Errorf("invalid %s create limit, values must not be negative", name)
+	}
+	return nil
+}
+
+// WorkDir is the directory machine dirs and checkpoints are kept in.
+func (c *Config) WorkDir() string {
+	workDir := c.MachineWorkDir
+	if workDir == "" {
+		workDir = c.CattleHome
+	}
+	return filepath.Join(workDir, "machine")
+}
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "go-machine-service"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Duration is a time.Duration that is written as a string such as "5m" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Errorf("invalid duration %s", b)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+type limitsFlag map[string]Limit
+
+func (f *limitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	entries := []string{}
+	for driver, limit := range *f {
+		entries = append(entries, fmt.Sprintf("%s=%d:%s:%d", driver, limit.MaxConcurrent,
+			strconv.FormatFloat(limit.Rate, 'g', -1, 64), limit.Burst))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (f *limitsFlag) Set(value string) error {
+	limits, err := ParseLimits(value)
+	if err != nil {
+		return err
+	}
+	if *f == nil {
+		*f = map[string]Limit{}
+	}
+	for driver, limit := range limits {
+		(*f)[driver] = limit
+	}
+	return nil
+}
+
+// ParseLimits parses per driver limits of the form
+// driver=maxConcurrent[:rate[:burst]][,driver=...].
+func ParseLimits(value string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid limit %q, expected driver=maxConcurrent[:rate[:burst]]", entry)
+		}
+
+		var (
+			limit Limit
+			err   error
+		)
+		parts := strings.Split(kv[1], ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid limit %q, expected driver=maxConcurrent[:rate[:burst]]", entry)
+		}
+		if limit.MaxConcurrent, err = strconv.Atoi(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid max concurrent creates in %q: %v", entry, err)
+		}
+		if len(parts) > 1 {
+			if limit.Rate, err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return nil, fmt.Errorf("invalid create rate in %q: %v", entry, err)
+			}
+		}
+		if len(parts) > 2 {
+			if limit.Burst, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid create burst in %q: %v", entry, err)
+			}
+		}
+		limits[kv[0]] = limit
+	}
+	return limits, nil
+}
+
+type rewritesFlag []ImageRewrite
+
+func (f *rewritesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	entries := []string{}
+	for _, rewrite := range *f {
+		entries = append(entries, rewrite.From+"="+rewrite.To)
+	}
+	return strings.Join(entries, ",")
+}
+
+// Set appends the rewrites, after those of the config file.
+func (f *rewritesFlag) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid image rewrite %q, expected from=to", entry)
+		}
+		*f = append(*f, ImageRewrite{From: strings.TrimSpace(kv[0]), To: strings.TrimSpace(kv[1])})
+	}
+	return nil
+}
+
+type phasesFlag Provisioning
+
+func (f *phasesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	entries := []string{}
+	for name, phase := range (*Provisioning)(f).phases() {
+		entries = append(entries, fmt.Sprintf("%s=%v:%d:%v", name, phase.Timeout, phase.Attempts, phase.Backoff))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (f *phasesFlag) Set(value string) error {
+	phases := (*Provisioning)(f).phases()
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid phase policy %q, expected phase=timeout[:attempts[:backoff]]", entry)
+		}
+		phase, ok := phases[kv[0]]
+		if !ok {
+			return fmt.Errorf("unknown provisioning phase %q", kv[0])
+		}
+		policy, err := ParsePhase(*phase, kv[1])
+		if err != nil {
+			return err
+		}
+		*phase = policy
+	}
+	return nil
+}
+
+// ParsePhase parses a phase policy of the form timeout[:attempts[:backoff]],
+// such as 10m:3:30s. Empty or missing fields keep their value in base, so
+// :5 only changes the attempts.
+func ParsePhase(base Phase, value string) (Phase, error) {
+	phase := base
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return phase, fmt.Errorf("invalid phase policy %q, expected timeout[:attempts[:backoff]]", value)
+	}
+
+	var err error
+	if parts[0] != "" {
+		if phase.Timeout.Duration, err = time.ParseDuration(parts[0]); err != nil {
+			return phase, fmt.Errorf("invalid timeout in %q: %v", value, err)
+		}
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		if phase.Attempts, err = strconv.Atoi(parts[1]); err != nil {
+			return phase, fmt.Errorf("invalid attempts in %q: %v", value, err)
+		}
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		if phase.Backoff.Duration, err = time.ParseDuration(parts[2]); err != nil {
+			return phase, fmt.Errorf("invalid backoff in %q: %v", value, err)
+		}
+	}
+	return phase, phase.validate()
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "gms-config")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{
+		"cattleUrl": "http://file:8080/v3",
+		"binDir": "/opt/file/bin",
+		"cattleHome": "/var/lib/file",
+		"drainTimeout": "30s",
+		"admission": {"drivers": {"amazonec2": {"maxConcurrent": 5}}}
+	}`)
+	assert.Nil(err)
+	f.Close()
+
+	c, err := Load([]string{"-config", f.Name(), "-bin-dir", "/opt/flag/bin", "-create-driver-limits", "packet=2", "-provision-phases", "agentContainer=2m"}, env(map[string]string{
+		"CATTLE_HOME": "/var/lib/env",
+		"GMS_BIN_DIR": "/opt/env/bin",
+	}))
+	assert.Nil(err)
+	assert.Equal("http://file:8080/v3", c.CattleURL)
+	assert.Equal("/var/lib/env", c.CattleHome)
+	assert.Equal("/opt/flag/bin", c.BinDir)
+	assert.Equal(30*time.Second, c.DrainTimeout.Duration)
+	assert.Equal(Limit{MaxConcurrent: 5}, c.Admission.Drivers["amazonec2"])
+	assert.Equal(Limit{MaxConcurrent: 2}, c.Admission.Drivers["packet"])
+	assert.Equal("/var/lib/env/machine", c.WorkDir())
+	// The unauthenticated status endpoints are only reachable locally by
+	// default, unlike the probes
+	assert.Equal("127.0.0.1:8114", c.ListenAddress)
+	assert.Equal(":8113", c.ProbeAddress)
+	assert.Equal(Phase{Timeout: Duration{2 * time.Minute}, Attempts: 30, Backoff: Duration{2 * time.Second}}, c.Provisioning.AgentContainer)
+}
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "gms-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{
+		writeConfigFile(t, dir, "config.json", `{
+			"cattleUrl": "http://file:8080/v3",
+			"drainTimeout": "30s",
+			"admission": {"drivers": {"amazonec2": {"maxConcurrent": 5}}},
+			"imageRewrites": [{"from": "docker.io/rancher/*", "to": "registry.internal/rancher/*"}]
+		}`),
+		writeConfigFile(t, dir, "config.yaml", `
+cattleUrl: http://file:8080/v3
+drainTimeout: 30s
+admission:
+  drivers:
+    amazonec2:
+      maxConcurrent: 5
+imageRewrites:
+- from: docker.io/rancher/*
+  to: registry.internal/rancher/*
+`),
+	} {
+		c, err := Load([]string{"-config", file}, env(map[string]string{}))
+		assert.Nil(err, file)
+		assert.Equal("http://file:8080/v3", c.CattleURL)
+		assert.Equal(30*time.Second, c.DrainTimeout.Duration)
+		assert.Equal(Limit{MaxConcurrent: 5}, c.Admission.Drivers["amazonec2"])
+		assert.Equal([]ImageRewrite{{From: "docker.io/rancher/*", To: "registry.internal/rancher/*"}}, c.ImageRewrites)
+	}
+}
+
+func TestLoadFileUnknownField(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "gms-config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	for file, field := range map[string]string{
+		writeConfigFile(t, dir, "top.json", `{"cattleUrl": "http://file:8080/v3", "cattleURI": "http://file"}`):                 "cattleURI",
+		writeConfigFile(t, dir, "nested.yml", "cattleUrl: http://file:8080/v3\nleases:\n  enable: true\n"):                      "leases.enable",
+		writeConfigFile(t, dir, "list.yaml", "cattleUrl: http://file:8080/v3\nimageRewrites:\n- from: a\n  into: b\n  to: b\n"): "imageRewrites[0].into",
+	} {
+		_, err := Load([]string{"-config", file}, env(map[string]string{}))
+		assert.NotNil(err, file)
+		assert.Contains(err.Error(), fmt.Sprintf("unknown field %q", field))
+	}
+
+	// Names match regardless of case, as they do when decoding
+	file := writeConfigFile(t, dir, "case.json", `{"CattleUrl": "http://file:8080/v3"}`)
+	_, err = Load([]string{"-config", file}, env(map[string]string{}))
+	assert.Nil(err)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := Load([]string{}, env(map[string]string{}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-loglevel", "chatty"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-create-max-concurrent", "-1"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-stuck-host-timeout", "0s"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-tracing-exporter", "otlp"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-provision-phases", "agentRegistration=5m:0"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-provision-phases", "boot=5m"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-machine-backend", "libmachine"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-agent-bootstrap", "tunnel"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-agent-ip-policy", "10.0.0.0"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-image-rewrites", "docker.io/rancher/*=registry.internal/rancher"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-provision-log-max-files", "0"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+
+	_, err = Load([]string{"-unknown"}, env(map[string]string{"CATTLE_URL": "http://localhost:8080/v3"}))
+	assert.NotNil(err)
+}
+
+func TestParsePhase(t *testing.T) {
+	assert := require.New(t)
+
+	base := Phase{Timeout: Duration{time.Hour}, Attempts: 1}
+	phase, err := ParsePhase(base, "10m:3:30s")
+	assert.Nil(err)
+	assert.Equal(Phase{Timeout: Duration{10 * time.Minute}, Attempts: 3, Backoff: Duration{30 * time.Second}}, phase)
+
+	phase, err = ParsePhase(base, ":5")
+	assert.Nil(err)
+	assert.Equal(Phase{Timeout: Duration{time.Hour}, Attempts: 5}, phase)
+
+	_, err = ParsePhase(base, "soon")
+	assert.NotNil(err)
+	_, err = ParsePhase(base, "1m:1:1s:1")
+	assert.NotNil(err)
+}
+
+func TestParseLimits(t *testing.T) {
+	assert := require.New(t)
+
+	limits, err := ParseLimits("amazonec2=5:0.5:2, packet=2")
+	assert.Nil(err)
+	assert.Equal(Limit{MaxConcurrent: 5, Rate: 0.5, Burst: 2}, limits["amazonec2"])
+	assert.Equal(Limit{MaxConcurrent: 2}, limits["packet"])
+
+	_, err = ParseLimits("amazonec2")
+	assert.NotNil(err)
+	_, err = ParseLimits("amazonec2=five")
+	assert.NotNil(err)
+}
+
+func TestProxy(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Empty(Proxy{NoProxy: "localhost"}.Env())
+
+	p := Proxy{HTTPProxy: "proxy.corp:3128", HTTPSProxy: "http://proxy.corp:3128", NoProxy: "localhost,.internal"}
+	p = p.WithNoProxy("cattle.example.com", "localhost")
+	assert.Equal("localhost,.internal,cattle.example.com", p.NoProxy)
+	assert.Equal([]string{
+		"HTTP_PROXY=proxy.corp:3128", "http_proxy=proxy.corp:3128",
+		"HTTPS_PROXY=http://proxy.corp:3128", "https_proxy=http://proxy.corp:3128",
+		"NO_PROXY=localhost,.internal,cattle.example.com", "no_proxy=localhost,.internal,cattle.example.com",
+	}, p.Env())
+
+	for target, expected := range map[string]string{
+		"http://releases.example.com/driver":       "http://proxy.corp:3128",
+		"https://github.com/driver":                "http://proxy.corp:3128",
+		"https://registry.internal/driver":         "",
+		"https://mirror.registry.internal/driver":  "",
+		"http://cattle.example.com:8080/v3/driver": "",
+	} {
+		req, err := http.NewRequest("GET", target, nil)
+		assert.Nil(err)
+		proxy, err := p.ProxyURL(req)
+		assert.Nil(err)
+		if expected == "" {
+			assert.Nil(proxy, target)
+		} else {
+			assert.Equal(expected, proxy.String(), target)
+		}
+	}
+}
+
+func TestHostname(t *testing.T) {
+	assert := require.New(t)
+
+	for rawurl, expected := range map[string]string{
+		"http://cattle.example.com:8080/v3": "cattle.example.com",
+		"https://cattle.example.com/v3":     "cattle.example.com",
+		"http://[fd00::1]:8080/v3":          "fd00::1",
+		"http://[fd00::1]/v3":               "fd00::1",
+		"/v3":                               "",
+	} {
+		u, err := url.Parse(rawurl)
+		assert.Nil(err)
+		assert.Equal(expected, Hostname(u), rawurl)
+	}
+}
@@ -53,7 +53,7 @@ func SyncBuiltin() error {
 	}
 
 	for _, driver := range installed {
-		logger.Infof("Deleting old builtin driver %s", driver)
+		logger.Infof("Deleting old builtin driver %s", driver.Name)
 		apiClient.MachineDriver.Delete(&driver)
 	}
 
@@ -18,7 +18,9 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-machine-service/logging"
 )
@@ -30,6 +32,7 @@ type Driver struct {
 	url     string
 	hash    string
 	name    string
+	log     *logrus.Entry
 }
 
 func NewDriver(builtin bool, name, url, hash string) *Driver {
@@ -38,6 +41,7 @@ func NewDriver(builtin bool, name, url, hash string) *Driver {
 		name:    name,
 		url:     url,
 		hash:    hash,
+		log:     logger,
 	}
 	if d.builtin && !strings.HasPrefix(d.name, "docker-machine-driver-") {
 		d.name = "docker-machine-driver-" + d.name
@@ -45,6 +49,13 @@ func NewDriver(builtin bool, name, url, hash string) *Driver {
 	return d
 }
 
+// WithLogger sets the logger the driver logs to, such as one carrying the
+// correlation ID of the event being handled.
+func (d *Driver) WithLogger(log *logrus.Entry) *Driver {
+	d.log = log
+	return d
+}
+
 func (d *Driver) Name() string {
 	return d.name
 }
@@ -102,7 +113,7 @@ func (d *Driver) getError() error {
 	errFile := d.cacheFile() + ".error"
 
 	if content, err := ioutil.ReadFile(errFile); err == nil {
-		logger.Errorf("Returning previous error: %s", content)
+		d.log.Errorf("Returning previous error: %s", content)
 		d.ClearError()
 		return errors.New(string(content))
 	}
@@ -110,6 +121,41 @@ func (d *Driver) getError() error {
 	return nil
 }
 
+// Error returns the error recorded by the last failed stage without clearing it.
+func (d *Driver) Error() error {
+	if content, err := ioutil.ReadFile(d.cacheFile() + ".error"); err == nil {
+		return errors.New(string(content))
+	}
+	return nil
+}
+
+// Staged returns whether the driver binary is available in the cache.
+func (d *Driver) Staged() bool {
+	if d.builtin {
+		return true
+	}
+	driverName, err := isInstalled(d.cacheFile())
+	return err == nil && driverName != ""
+}
+
+// Installed returns whether the staged driver binary is in the cache and installed in the bin dir.
+func (d *Driver) Installed() bool {
+	if d.builtin {
+		return true
+	}
+	driverName, err := isInstalled(d.cacheFile())
+	if err != nil || driverName == "" {
+		return false
+	}
+	d.name = driverName
+	for _, file := range []string{d.srcBinName(), path.Join(binDir(), d.name)} {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *Driver) ClearError() {
 	errFile := d.cacheFile() + ".error"
 	os.Remove(errFile)
@@ -185,7 +231,7 @@ func (d *Driver) Install() error {
 	}
 	defer src.Close()
 
-	logger.Infof("Copying %v => %v", d.srcBinName(), tmpPath)
+	d.log.Infof("Copying %v => %v", d.srcBinName(), tmpPath)
 	_, err = io.Copy(f, src)
 	if err != nil {
 		return errors.Wrapf(err, "Couldn't copy %v to %v", d.srcBinName(), tmpPath)
@@ -277,7 +323,7 @@ func (d *Driver) copyBinary(cacheFile, input string) (string, error) {
 		return "", err
 	}
 
-	logger.Infof("Found driver %s", driverName)
+	d.log.Infof("Found driver %s", driverName)
 	return driverName, ioutil.WriteFile(cacheFile, []byte(driverName), 0644)
 }
 
@@ -286,11 +332,7 @@ func (d *Driver) srcBinName() string {
 }
 
 func binDir() string {
-	dest := os.Getenv("GMS_BIN_DIR")
-	if dest != "" {
-		return dest
-	}
-	return "/usr/local/bin"
+	return conf.BinDir
 }
 
 func compare(hash hash.Hash, value string) (string, bool) {
@@ -321,27 +363,47 @@ func getHasher(hash string) (hash.Hash, error) {
 	return nil, fmt.Errorf("Invalid hash format: %s", hash)
 }
 
-func (d *Driver) download(dest io.Writer) error {
-	logger.Infof("Download %s", d.url)
-	resp, err := http.Get(d.url)
+func (d *Driver) download(dest io.Writer) (err error) {
+	d.log.Infof("Download %s", d.url)
+	start := time.Now()
+	counter := &countingWriter{Writer: dest}
+	defer func() {
+		downloadBytes.Add(float64(counter.count), d.FriendlyName())
+		downloadDuration.Since(start, d.FriendlyName())
+		if err != nil {
+			downloadFailures.Inc(d.FriendlyName())
+		}
+	}()
+
+	resp, err := downloadClient().Get(d.url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(dest, resp.Body)
+	_, err = io.Copy(counter, resp.Body)
 	return err
 }
 
+// downloadClient returns the HTTP client of driver downloads, which go
+// through the configured proxy, or the one of the environment if none is.
+func downloadClient() *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if conf.Proxy.Enabled() {
+		proxy = conf.Proxy.ProxyURL
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
 func (d *Driver) cacheFile() string {
 	key := sha256Bytes([]byte(d.url + d.hash))
 
-	base := os.Getenv("CATTLE_HOME")
-	if base == "" {
-		base = "/var/lib/cattle"
-	}
-
-	return path.Join(base, "machine-drivers", key)
+	return path.Join(conf.CattleHome, "machine-drivers", key)
 }
 
 func isInstalled(file string) (string, error) {
@@ -5,11 +5,13 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	cli "github.com/docker/machine/libmachine/mcnflag"
 
 	"net/rpc"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
 	rpcdriver "github.com/docker/machine/libmachine/drivers/rpc"
 	"github.com/rancher/go-rancher/v3"
@@ -66,12 +68,12 @@ func flagToField(flag cli.Flag) (string, client.Field, error) {
 	return name, field, nil
 }
 
-func GenerateAndUploadSchema(driver string) error {
+func GenerateAndUploadSchema(driver string, log *logrus.Entry) error {
 	schemaLock.Lock()
 	defer schemaLock.Unlock()
 
 	driverName := strings.TrimPrefix(driver, "docker-machine-driver-")
-	flags, err := getCreateFlagsForDriver(driverName)
+	flags, err := getCreateFlagsForDriver(driverName, log)
 	if err != nil {
 		return err
 	}
@@ -92,10 +94,10 @@ func GenerateAndUploadSchema(driver string) error {
 	if err != nil {
 		return err
 	}
-	return uploadDynamicSchema(driverName+"Config", json, schemaBase, schemaRoles, true)
+	return uploadDynamicSchema(driverName+"Config", json, schemaBase, schemaRoles, true, log)
 }
 
-func RemoveSchemas(schemaName string, apiClient *client.RancherClient) error {
+func RemoveSchemas(schemaName string, apiClient *client.RancherClient, log *logrus.Entry) error {
 	listOpts := &client.ListOpts{
 		Filters: map[string]interface{}{
 			"name":         schemaName,
@@ -121,7 +123,7 @@ func RemoveSchemas(schemaName string, apiClient *client.RancherClient) error {
 			continue
 		}
 
-		logger.Debugf("Removing %s id: %s state: %s", schemaName, schema.Id, schema.State)
+		log.Debugf("Removing %s id: %s state: %s", schemaName, schema.Id, schema.State)
 		if err := apiClient.DynamicSchema.Delete(&schema); err != nil {
 			return err
 		}
@@ -134,13 +136,15 @@ func RemoveSchemas(schemaName string, apiClient *client.RancherClient) error {
 	return nil
 }
 
-func uploadDynamicSchema(schemaName, definition, parent string, roles []string, delete bool) error {
+func uploadDynamicSchema(schemaName, definition, parent string, roles []string, delete bool, log *logrus.Entry) error {
+	defer schemaUploadDuration.Since(time.Now(), schemaName)
+
 	apiClient, err := getClient()
 	if err != nil {
 		return err
 	}
 	if delete {
-		RemoveSchemas(schemaName, apiClient)
+		RemoveSchemas(schemaName, apiClient, log)
 	}
 
 	schema, err := apiClient.DynamicSchema.Create(&client.DynamicSchema{
@@ -149,7 +153,7 @@ func uploadDynamicSchema(schemaName, definition, parent string, roles []string,
 		Parent:     parent,
 		Roles:      roles,
 	})
-	logger.WithField("id", schema.Id).Infof("Creating schema %s, roles %v", schemaName, roles)
+	log.WithField("id", schema.Id).Infof("Creating schema %s, roles %v", schemaName, roles)
 	if err != nil {
 		return fmt.Errorf("Failed when uploading %s schema: %v", schemaName, err)
 	}
@@ -157,8 +161,8 @@ func uploadDynamicSchema(schemaName, definition, parent string, roles []string,
 	return waitSchema(*schema, apiClient)
 }
 
-func getCreateFlagsForDriver(driver string) ([]cli.Flag, error) {
-	logger.Debug("Starting binary ", driver)
+func getCreateFlagsForDriver(driver string, log *logrus.Entry) ([]cli.Flag, error) {
+	log.Debug("Starting binary ", driver)
 	p, err := localbinary.NewPlugin(driver)
 	if err != nil {
 		return nil, err
@@ -166,7 +170,7 @@ func getCreateFlagsForDriver(driver string) ([]cli.Flag, error) {
 	go func() {
 		err := p.Serve()
 		if err != nil {
-			logger.Debugf("Error serving plugin server for driver=%s, err=%v", driver, err)
+			log.Debugf("Error serving plugin server for driver=%s, err=%v", driver, err)
 		}
 	}()
 	defer p.Close()
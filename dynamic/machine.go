@@ -3,10 +3,12 @@ package dynamic
 import (
 	"strings"
 
+	"github.com/Sirupsen/logrus"
+
 	"github.com/rancher/go-rancher/v3"
 )
 
-func UploadMachineSchemas(apiClient *client.RancherClient, drivers ...string) error {
+func UploadMachineSchemas(apiClient *client.RancherClient, log *logrus.Entry, drivers ...string) error {
 	schemaLock.Lock()
 	defer schemaLock.Unlock()
 
@@ -25,17 +27,17 @@ func UploadMachineSchemas(apiClient *client.RancherClient, drivers ...string) er
 		}
 	}
 
-	logger.Infof("Updating machine jsons for  %v", drivers)
-	if err := uploadMachineServiceJSON(drivers, true); err != nil {
+	log.Infof("Updating machine jsons for  %v", drivers)
+	if err := uploadMachineServiceJSON(drivers, true, log); err != nil {
 		return err
 	}
-	if err := uploadMachineProjectJSON(drivers, false); err != nil {
+	if err := uploadMachineProjectJSON(drivers, false, log); err != nil {
 		return err
 	}
-	if err := uploadMachineUserJSON(drivers, false); err != nil {
+	if err := uploadMachineUserJSON(drivers, false, log); err != nil {
 		return err
 	}
-	return uploadMachineReadOnlyJSON(false)
+	return uploadMachineReadOnlyJSON(false, log)
 }
 
 func field(resourceFields map[string]client.Field, field, fieldType, auth string) {
@@ -78,34 +80,34 @@ func baseSchema(drivers []string, defaultAuth string) client.Schema {
 	return schema
 }
 
-func uploadMachineServiceJSON(drivers []string, remove bool) error {
+func uploadMachineServiceJSON(drivers []string, remove bool, log *logrus.Entry) error {
 	schema := baseSchema(drivers, "cu")
 	field(schema.ResourceFields, "extractedConfig", "string", "u")
 	field(schema.ResourceFields, "labels", "map[string]", "cu")
 
-	return uploadMachineSchema(schema, []string{"service"}, remove)
+	return uploadMachineSchema(schema, []string{"service"}, remove, log)
 }
 
-func uploadMachineProjectJSON(drivers []string, remove bool) error {
+func uploadMachineProjectJSON(drivers []string, remove bool, log *logrus.Entry) error {
 	schema := baseSchema(drivers, "cu")
-	return uploadMachineSchema(schema, []string{"project", "member", "owner"}, remove)
+	return uploadMachineSchema(schema, []string{"project", "member", "owner"}, remove, log)
 }
 
-func uploadMachineUserJSON(drivers []string, remove bool) error {
+func uploadMachineUserJSON(drivers []string, remove bool, log *logrus.Entry) error {
 	schema := baseSchema(drivers, "cu")
-	return uploadMachineSchema(schema, []string{"admin", "user", "readAdmin"}, remove)
+	return uploadMachineSchema(schema, []string{"admin", "user", "readAdmin"}, remove, log)
 }
 
-func uploadMachineReadOnlyJSON(remove bool) error {
+func uploadMachineReadOnlyJSON(remove bool, log *logrus.Entry) error {
 	schema := baseSchema([]string{}, "")
-	return uploadMachineSchema(schema, []string{"readonly"}, remove)
+	return uploadMachineSchema(schema, []string{"readonly"}, remove, log)
 }
 
-func uploadMachineSchema(schema client.Schema, roles []string, remove bool) error {
+func uploadMachineSchema(schema client.Schema, roles []string, remove bool, log *logrus.Entry) error {
 	json, err := toJSON(&schema)
 	if err != nil {
 		return err
 	}
-	err = uploadDynamicSchema("host", json, "host", roles, remove)
+	err = uploadDynamicSchema("host", json, "host", roles, remove, log)
 	return err
 }
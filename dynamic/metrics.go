@@ -0,0 +1,31 @@
+package dynamic
+
+import (
+	"io"
+
+	"github.com/rancher/go-machine-service/metrics"
+)
+
+var (
+	downloadBytes = metrics.NewCounter("gms_driver_download_bytes_total",
+		"Bytes downloaded for machine drivers.", "driver")
+	downloadDuration = metrics.NewHistogram("gms_driver_download_duration_seconds",
+		"Duration of machine driver downloads.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120}, "driver")
+	downloadFailures = metrics.NewCounter("gms_driver_download_failures_total",
+		"Failed machine driver downloads.", "driver")
+	driverRepairs = metrics.NewCounter("gms_driver_repairs_total",
+		"Machine drivers re-staged and re-installed by the reconciler, by result.", "driver", "result")
+	schemaUploadDuration = metrics.NewHistogram("gms_schema_upload_duration_seconds",
+		"Duration of dynamic schema uploads.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "schema")
+)
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,59 @@
+package dynamic
+
+import (
+	"os"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+// ReconcileDrivers re-stages and re-installs the active machine drivers whose
+// binary is missing from the cache or the bin dir, such as after a failed
+// download or when the bin dir was cleaned up.
+func ReconcileDrivers() error {
+	apiClient, err := getClient()
+	if err != nil {
+		return err
+	}
+
+	opts := client.NewListOpts()
+	opts.Filters["state"] = "active"
+
+	drivers, err := apiClient.MachineDriver.List(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, driverInfo := range drivers.Data {
+		driver := NewDriver(driverInfo.Builtin, driverInfo.Name, driverInfo.Url, driverInfo.Checksum)
+		if driver.Installed() {
+			continue
+		}
+
+		logger.Infof("Repairing driver %s", driverInfo.Name)
+		if err := repair(driver); err != nil {
+			logger.Errorf("Failed to repair driver %s: %v", driverInfo.Name, err)
+			driverRepairs.Inc(driverInfo.Name, "error")
+			continue
+		}
+		driverRepairs.Inc(driverInfo.Name, "success")
+	}
+
+	return nil
+}
+
+func repair(driver *Driver) error {
+	// A previous failure would be returned by Stage instead of retrying it
+	driver.ClearError()
+
+	// The cache may name a binary that no longer exists, download it again
+	if _, err := os.Stat(driver.srcBinName()); os.IsNotExist(err) {
+		if err := driver.Remove(); err != nil {
+			return err
+		}
+	}
+
+	if err := driver.Stage(); err != nil {
+		return err
+	}
+	return driver.Install()
+}
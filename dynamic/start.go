@@ -86,3 +86,43 @@ func DownloadAllDrivers() error {
 	logger.Info("Done downloading all drivers")
 	return nil
 }
+
+type DriverStatus struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Staged bool   `json:"staged"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DriverStatuses reports whether each machine driver known to Cattle is staged
+// locally or has a staging error recorded.
+func DriverStatuses() ([]DriverStatus, error) {
+	apiClient, err := getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := client.NewListOpts()
+	opts.Filters["removed_null"] = "true"
+
+	drivers, err := apiClient.MachineDriver.List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []DriverStatus{}
+	for _, driverInfo := range drivers.Data {
+		driver := NewDriver(driverInfo.Builtin, driverInfo.Name, driverInfo.Url, driverInfo.Checksum)
+		status := DriverStatus{
+			Name:   driverInfo.Name,
+			State:  driverInfo.State,
+			Staged: driver.Staged(),
+		}
+		if err := driver.Error(); err != nil {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
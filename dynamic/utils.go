@@ -3,10 +3,10 @@ package dynamic
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
+	"github.com/rancher/go-machine-service/config"
 	"github.com/rancher/go-rancher/v3"
 )
 
@@ -14,15 +14,18 @@ var (
 	maxWait = 1 * time.Second
 )
 
-func getClient() (*client.RancherClient, error) {
-	apiURL := os.Getenv("CATTLE_URL")
-	accessKey := os.Getenv("CATTLE_ACCESS_KEY")
-	secretKey := os.Getenv("CATTLE_SECRET_KEY")
+var conf = config.Default()
+
+// Configure sets the configuration used by the dynamic package.
+func Configure(c *config.Config) {
+	conf = c
+}
 
+func getClient() (*client.RancherClient, error) {
 	return client.NewRancherClient(&client.ClientOpts{
-		Url:       apiURL,
-		AccessKey: accessKey,
-		SecretKey: secretKey,
+		Url:       conf.CattleURL,
+		AccessKey: conf.CattleAccessKey,
+		SecretKey: conf.CattleSecretKey,
 		Timeout:   time.Second * 60,
 	})
 }
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-machine-service/config"
+)
+
+var admission = &admissionController{}
+
+// configureAdmission sets the limits applied in front of docker-machine create.
+func configureAdmission(config config.Admission) {
+	admission.Lock()
+	defer admission.Unlock()
+	admission.config = config
+	admission.queueByKey = map[string]*admissionQueue{}
+}
+
+type admissionController struct {
+	sync.Mutex
+	config     config.Admission
+	queueByKey map[string]*admissionQueue
+}
+
+// queues returns the queues a create for the driver and host template goes
+// through: the one of the host template, if creates are limited per host
+// template, then the one of the driver, which always applies so that the
+// templates of a driver share its limit.
+func (a *admissionController) queues(driver, hostTemplateID string) []*admissionQueue {
+	a.Lock()
+	defer a.Unlock()
+
+	limit, ok := a.config.Drivers[driver]
+	if !ok {
+		limit = a.config.Default
+	}
+	queues := []*admissionQueue{}
+	if a.config.PerHostTemplate && hostTemplateID != "" {
+		queues = append(queues, a.queue(driver+"/"+hostTemplateID, limit))
+	}
+	return append(queues, a.queue(driver, limit))
+}
+
+func (a *admissionController) queue(key string, limit config.Limit) *admissionQueue {
+	if a.queueByKey == nil {
+		a.queueByKey = map[string]*admissionQueue{}
+	}
+	q, ok := a.queueByKey[key]
+	if !ok {
+		q = newAdmissionQueue(limit)
+		a.queueByKey[key] = q
+	}
+	return q
+}
+
+// admit blocks until a create for the driver and host template may start. While
+// waiting, notify is called with the 1-based queue position whenever it changes.
+// The returned func must be called when the create has finished. If cancel is
+// closed first, admit gives up its place in the queues and returns false.
+func admit(driver, hostTemplateID string, cancel <-chan struct{}, notify func(position int)) (func(), bool) {
+	acquired := []*admissionQueue{}
+	release := func() {
+		for _, q := range acquired {
+			q.release()
+		}
+	}
+	for _, q := range admission.queues(driver, hostTemplateID) {
+		if !q.acquire(cancel, notify) {
+			release()
+			return nil, false
+		}
+		acquired = append(acquired, q)
+	}
+	return release, true
+}
+
+type admissionQueue struct {
+	sync.Mutex
+	limit   config.Limit
+	running int
+	tokens  float64
+	last    time.Time
+	waiters []*admissionWaiter
+	changed chan struct{}
+}
+
+// admissionWaiter must not be zero-sized, so that each waiter has a distinct address.
+type admissionWaiter struct {
+	_ byte
+}
+
+func newAdmissionQueue(limit config.Limit) *admissionQueue {
+	if limit.Rate > 0 && limit.Burst < 1 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return &admissionQueue{
+		limit:   limit,
+		tokens:  float64(limit.Burst),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (q *admissionQueue) acquire(cancel <-chan struct{}, notify func(position int)) bool {
+	w := &admissionWaiter{}
+
+	q.Lock()
+	q.waiters = append(q.waiters, w)
+	lastPosition := 0
+	for {
+		position := q.position(w)
+		var wait time.Duration
+		if position == 1 && (q.limit.MaxConcurrent <= 0 || q.running < q.limit.MaxConcurrent) {
+			if wait = q.takeToken(time.Now()); wait == 0 {
+				q.running++
+				q.waiters = q.waiters[1:]
+				q.broadcast()
+				q.Unlock()
+				return true
+			}
+		}
+
+		changed := q.changed
+		q.Unlock()
+
+		if position != lastPosition {
+			lastPosition = position
+			notify(position)
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-changed:
+		case <-timer:
+		case <-cancel:
+			q.Lock()
+			q.remove(w)
+			q.broadcast()
+			q.Unlock()
+			return false
+		}
+
+		q.Lock()
+	}
+}
+
+func (q *admissionQueue) remove(w *admissionWaiter) {
+	for i, waiter := range q.waiters {
+		if waiter == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *admissionQueue) release() {
+	q.Lock()
+	defer q.Unlock()
+	q.running--
+	q.broadcast()
+}
+
+func (q *admissionQueue) position(w *admissionWaiter) int {
+	for i, waiter := range q.waiters {
+		if waiter == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// takeToken takes a token from the bucket, or returns how long until one is available.
+func (q *admissionQueue) takeToken(now time.Time) time.Duration {
+	if q.limit.Rate <= 0 {
+		return 0
+	}
+	q.tokens = math.Min(float64(q.limit.Burst), q.tokens+now.Sub(q.last).Seconds()*q.limit.Rate)
+	q.last = now
+	if q.tokens >= 1 {
+		q.tokens--
+		return 0
+	}
+	return time.Duration((1 - q.tokens) / q.limit.Rate * float64(time.Second))
+}
+
+func (q *admissionQueue) broadcast() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/go-machine-service/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionQueue(t *testing.T) {
+	assert := require.New(t)
+
+	q := newAdmissionQueue(config.Limit{MaxConcurrent: 1})
+	assert.True(q.acquire(nil, func(int) { t.Error("first acquire should not be queued") }))
+
+	positions := make(chan int, 10)
+	admitted := make(chan struct{})
+	go func() {
+		q.acquire(nil, func(position int) { positions <- position })
+		close(admitted)
+	}()
+
+	assert.Equal(1, <-positions)
+	select {
+	case <-admitted:
+		t.Fatal("second acquire should wait for release")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	q.release()
+	<-admitted
+}
+
+func TestAdmissionCancel(t *testing.T) {
+	assert := require.New(t)
+
+	q := newAdmissionQueue(config.Limit{MaxConcurrent: 1})
+	assert.True(q.acquire(nil, func(int) {}))
+
+	cancel := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		result <- q.acquire(cancel, func(int) {})
+	}()
+
+	close(cancel)
+	assert.False(<-result)
+	assert.Empty(q.waiters)
+}
+
+func TestAdmissionRate(t *testing.T) {
+	assert := require.New(t)
+
+	q := newAdmissionQueue(config.Limit{Rate: 10, Burst: 1})
+	now := time.Now()
+	assert.Equal(time.Duration(0), q.takeToken(now))
+	assert.True(q.takeToken(now) > 0)
+	assert.Equal(time.Duration(0), q.takeToken(now.Add(100*time.Millisecond)))
+}
+
+func TestAdmissionPerHostTemplate(t *testing.T) {
+	assert := require.New(t)
+
+	defer configureAdmission(config.Admission{})
+	configureAdmission(config.Admission{
+		Drivers:         map[string]config.Limit{"amazonec2": {MaxConcurrent: 1}},
+		PerHostTemplate: true,
+	})
+
+	release, ok := admit("amazonec2", "1ht1", nil, func(int) { t.Error("first admit should not be queued") })
+	assert.True(ok)
+
+	admitted := make(chan func())
+	go func() {
+		release, _ := admit("amazonec2", "1ht2", nil, func(int) {})
+		admitted <- release
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("another template of the driver should wait for the driver limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	release = <-admitted
+	release()
+	assert.Equal(0, admission.queue("amazonec2", config.Limit{}).running)
+	assert.Equal(0, admission.queue("amazonec2/1ht1", config.Limit{}).running)
+}
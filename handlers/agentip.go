@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// agentIPPolicyField is the host template value overriding the configured
+	// agent IP policy of its hosts.
+	agentIPPolicyField = "agentIpPolicy"
+	agentIPEnv         = "CATTLE_AGENT_IP"
+)
+
+// driverIPFields are the fields of the driver state, as docker-machine inspect
+// shows it, that hold an IP of the machine.
+var driverIPFields = []string{"IPAddress", "PrivateIPAddress", "PrivateIP"}
+
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// hostAgentIPPolicy returns the agent IP policy of the host, its template
+// already applied.
+func hostAgentIPPolicy(host *v3.Host) (string, error) {
+	policy := conf.AgentIPPolicy
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	if value, _ := fields[agentIPPolicyField].(string); value != "" {
+		policy = value
+	}
+	if err := config.ValidateAgentIPPolicy(policy); err != nil {
+		return "", errors.Wrapf(err, "Invalid %s template value", agentIPPolicyField)
+	}
+	return policy, nil
+}
+
+// validateAgentSettings checks the agent spec and the agent IP policy of the
+// host, its template already applied, so that an invalid one fails the
+// provisioning before the machine is created rather than once it runs.
+func validateAgentSettings(host *v3.Host) error {
+	if _, err := hostAgentSpec(host); err != nil {
+		return err
+	}
+	_, err := hostAgentIPPolicy(host)
+	return err
+}
+
+// resolveAgentIP returns the IP of the machine of the host the agent registers
+// with, as its policy picks it, or "" to leave the agent to detect it, such as
+// when no address of the machine matches.
+func resolveAgentIP(host *v3.Host, hostDir string, log *logrus.Entry) (string, error) {
+	policy, err := hostAgentIPPolicy(host)
+	if err != nil || policy == "" {
+		return "", err
+	}
+
+	ips := []net.IP{}
+	reported, err := machines.ip(hostDir, host.Hostname)
+	if err != nil {
+		log.Warnf("Failed to get the IP of the machine: %v", err)
+	} else if ip := net.ParseIP(reported); ip != nil {
+		ips = append(ips, ip)
+	}
+	stateIPs, err := driverStateIPs(hostDir, host.Hostname)
+	if err != nil {
+		log.Warnf("Failed to read the IPs of the driver state: %v", err)
+	}
+	ips = append(ips, stateIPs...)
+
+	ip := selectAgentIP(policy, ips)
+	if ip == nil {
+		log.Warnf("No IP of the machine among %v matches agent IP policy %q, leaving the agent to detect it", ips, policy)
+		return "", nil
+	}
+	log.Infof("Agent registers with IP %s, by agent IP policy %q", ip, policy)
+	return ip.String(), nil
+}
+
+// driverStateIPs returns the IPs the driver state of the machine holds.
+func driverStateIPs(machineDir, name string) ([]net.IP, error) {
+	content, err := ioutil.ReadFile(hostConfigFile(machineDir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	hc := struct {
+		Driver map[string]interface{}
+	}{}
+	if err := json.Unmarshal(content, &hc); err != nil {
+		return nil, errors.Wrapf(err, "Reading config of machine %s", name)
+	}
+
+	ips := []net.IP{}
+	for _, field := range driverIPFields {
+		value, _ := hc.Driver[field].(string)
+		if ip := net.ParseIP(value); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// selectAgentIP returns the first of the IPs matching the policy, or nil.
+// Loopback, link local and unspecified IPs never match.
+func selectAgentIP(policy string, ips []net.IP) net.IP {
+	var network *net.IPNet
+	if policy != config.AgentIPPublic && policy != config.AgentIPPrivate {
+		_, network, _ = net.ParseCIDR(policy)
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		switch {
+		case policy == config.AgentIPPublic && !isPrivateIP(ip),
+			policy == config.AgentIPPrivate && isPrivateIP(ip),
+			network != nil && network.Contains(ip):
+			return ip
+		}
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportAgentIP sets the agent IP of the host before the agent registers with it.
+func reportAgentIP(host *v3.Host, ip string, apiClient *v3.RancherClient) error {
+	_, err := apiClient.Host.Update(host, map[string]interface{}{
+		"agentIpAddress": ip,
+	})
+	return err
+}
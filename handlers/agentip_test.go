@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectAgentIP(t *testing.T) {
+	assert := require.New(t)
+
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("172.31.5.10"),
+		net.ParseIP("54.12.3.4"),
+		net.ParseIP("10.2.0.7"),
+	}
+	assert.Equal("54.12.3.4", selectAgentIP("public", ips).String())
+	assert.Equal("172.31.5.10", selectAgentIP("private", ips).String())
+	assert.Equal("10.2.0.7", selectAgentIP("10.0.0.0/8", ips).String())
+	assert.Nil(selectAgentIP("192.168.0.0/16", ips))
+	assert.Nil(selectAgentIP("public", ips[1:2]))
+}
+
+func TestResolveAgentIP(t *testing.T) {
+	assert := require.New(t)
+
+	machineDir, err := ioutil.TempDir("", "gms-agentip")
+	assert.Nil(err)
+	defer os.RemoveAll(machineDir)
+	writeHostConfig(t, machineDir, "host1", `{"ConfigVersion": 3, "DriverName": "amazonec2", "Name": "host1",
+		"Driver": {"IPAddress": "1.2.3.4", "PrivateIPAddress": "172.31.5.10"}}`)
+
+	defer func(backend machineBackend) {
+		machines = backend
+	}(machines)
+	machines = &recordingBackend{}
+	log := logger.WithField("test", "TestResolveAgentIP")
+
+	host := &v3.Host{Hostname: "host1", Data: map[string]interface{}{"fields": map[string]interface{}{}}}
+	ip, err := resolveAgentIP(host, machineDir, log)
+	assert.Nil(err)
+	assert.Equal("", ip)
+
+	host.Data["fields"].(map[string]interface{})[agentIPPolicyField] = "private"
+	ip, err = resolveAgentIP(host, machineDir, log)
+	assert.Nil(err)
+	assert.Equal("172.31.5.10", ip)
+
+	host.Data["fields"].(map[string]interface{})[agentIPPolicyField] = "public"
+	ip, err = resolveAgentIP(host, machineDir, log)
+	assert.Nil(err)
+	assert.Equal("1.2.3.4", ip)
+
+	host.Data["fields"].(map[string]interface{})[agentIPPolicyField] = "10.0.0.0/33"
+	_, err = resolveAgentIP(host, machineDir, log)
+	assert.NotNil(err)
+
+	host.AgentIpAddress = "172.31.5.10"
+	config := buildContainerConfig([]string{"http://cattle:8080/v3/scripts/token"}, host, "rancher/agent", "v2.0")
+	assert.Contains(config.Env, "CATTLE_AGENT_IP=172.31.5.10")
+}
+
+func TestValidateAgentSettings(t *testing.T) {
+	assert := require.New(t)
+
+	fields := map[string]interface{}{}
+	host := &v3.Host{Data: map[string]interface{}{"fields": fields}}
+	assert.Nil(validateAgentSettings(host))
+
+	fields[agentIPPolicyField] = "10.0.0.0/33"
+	assert.NotNil(validateAgentSettings(host))
+
+	fields[agentIPPolicyField] = "private"
+	fields[agentSpecField] = map[string]interface{}{"binds": []interface{}{"/data"}}
+	assert.NotNil(validateAgentSettings(host))
+}
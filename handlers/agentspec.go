@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// agentSpecField is the host template value, public or secret, holding
+	// the agent spec of its hosts.
+	agentSpecField = "agentSpec"
+	// agentSpecLabel holds the agent spec of the host as JSON, such as
+	// {"env": {"CATTLE_AGENT_IP": "10.0.0.5"}}. It overrides the one of the
+	// host template.
+	agentSpecLabel = "io.rancher.host.agent.spec"
+)
+
+var (
+	// reservedAgentEnv are the variables the agent is started with which a
+	// spec can't override.
+	reservedAgentEnv = map[string]bool{
+		"CATTLE_PHYSICAL_HOST_UUID": true,
+		"CATTLE_HOST_LABELS":        true,
+	}
+	envNameRegEx    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	volumeNameRegEx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	bindOptions     = map[string]bool{
+		"ro": true, "rw": true, "z": true, "Z": true, "nocopy": true,
+		"shared": true, "rshared": true, "slave": true, "rslave": true,
+		"private": true, "rprivate": true,
+	}
+)
+
+// agentSpec overrides the bootstrap agent container of a host: its image,
+// extra env and extra binds.
+type agentSpec struct {
+	Image string            `json:"image,omitempty"`
+	Env   map[string]string `json:"env,omitempty"`
+	Binds []string          `json:"binds,omitempty"`
+}
+
+// hostAgentSpec returns the agent spec of the host, its template already
+// applied: the one of its template, overridden by the one of its label. An
+// invalid spec is an error rather than ignored, as the agent would not start
+// the way it is expected to.
+func hostAgentSpec(host *v3.Host) (*agentSpec, error) {
+	spec := &agentSpec{}
+
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	if value, ok := fields[agentSpecField]; ok && value != nil {
+		templateSpec, err := decodeAgentSpec(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid %s template value", agentSpecField)
+		}
+		spec.override(templateSpec)
+	}
+	if value, ok := host.Labels[agentSpecLabel].(string); ok && value != "" {
+		labelSpec, err := decodeAgentSpec(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid %s label", agentSpecLabel)
+		}
+		spec.override(labelSpec)
+	}
+
+	if err := spec.validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid agent spec")
+	}
+	return spec, nil
+}
+
+// decodeAgentSpec decodes a spec given as JSON or as the object it encodes.
+func decodeAgentSpec(value interface{}) (*agentSpec, error) {
+	content, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		content = string(encoded)
+	}
+	spec := &agentSpec{}
+	if err := json.Unmarshal([]byte(content), spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// override sets the image and the env of o in s and adds its binds.
+func (s *agentSpec) override(o *agentSpec) {
+	if o.Image != "" {
+		s.Image = o.Image
+	}
+	for name, value := range o.Env {
+		if s.Env == nil {
+			s.Env = map[string]string{}
+		}
+		s.Env[name] = value
+	}
+	s.Binds = append(s.Binds, o.Binds...)
+}
+
+func (s *agentSpec) validate() error {
+	if s.Image != "" {
+		if repo, _, err := parseImage(s.Image); err != nil || repo == "" {
+			return errors.Errorf("invalid image %q", s.Image)
+		}
+	}
+	for name := range s.Env {
+		if !envNameRegEx.MatchString(name) {
+			return errors.Errorf("invalid env name %q", name)
+		}
+		if reservedAgentEnv[name] {
+			return errors.Errorf("env %s can't be overridden", name)
+		}
+	}
+
+	reserved := map[string]bool{}
+	for _, bind := range buildHostConfig().Binds {
+		reserved[strings.Split(bind, ":")[1]] = true
+	}
+	destinations := map[string]bool{}
+	for _, bind := range s.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return errors.Errorf("invalid bind %q, expected source:destination[:options]", bind)
+		}
+		source, destination := parts[0], parts[1]
+		if !path.IsAbs(source) && !volumeNameRegEx.MatchString(source) {
+			return errors.Errorf("invalid bind %q, the source is neither an absolute path nor a volume", bind)
+		}
+		if !path.IsAbs(destination) {
+			return errors.Errorf("invalid bind %q, the destination is not an absolute path", bind)
+		}
+		destination = path.Clean(destination)
+		if reserved[destination] {
+			return errors.Errorf("invalid bind %q, %s is already bound", bind, destination)
+		}
+		if destinations[destination] {
+			return errors.Errorf("invalid bind %q, %s is bound twice", bind, destination)
+		}
+		destinations[destination] = true
+		if len(parts) == 3 {
+			for _, option := range strings.Split(parts[2], ",") {
+				if !bindOptions[option] {
+					return errors.Errorf("invalid bind %q, unknown option %q", bind, option)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// image returns the image of the spec, rewritten as configured, or repo and
+// tag if it sets none.
+func (s *agentSpec) image(repo, tag string) (string, string, error) {
+	if s.Image == "" {
+		return repo, tag, nil
+	}
+	specRepo, specTag, err := parseImage(rewriteImage(s.Image))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Invalid agent spec image %q", s.Image)
+	}
+	if specTag == "" {
+		specTag = "latest"
+	}
+	return specRepo, specTag, nil
+}
+
+// merge adds the env and the binds of the spec to the generated container
+// config. Its env replaces the generated variables of the same name, such as
+// those of the proxy.
+func (s *agentSpec) merge(config *container.Config, hostConfig *container.HostConfig) {
+	if len(s.Env) > 0 {
+		env := []string{}
+		for _, variable := range config.Env {
+			if _, ok := s.Env[strings.SplitN(variable, "=", 2)[0]]; !ok {
+				env = append(env, variable)
+			}
+		}
+		names := []string{}
+		for name := range s.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			env = append(env, name+"="+s.Env[name])
+		}
+		config.Env = env
+	}
+
+	for _, bind := range s.Binds {
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+		if config.Volumes == nil {
+			config.Volumes = map[string]struct{}{}
+		}
+		config.Volumes[path.Clean(strings.Split(bind, ":")[1])] = struct{}{}
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"testing"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostAgentSpec(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{
+		Data: map[string]interface{}{"fields": map[string]interface{}{
+			agentSpecField: map[string]interface{}{
+				"image": "registry.internal/rancher/agent:v2.0",
+				"env":   map[string]interface{}{"CATTLE_AGENT_IP": "10.0.0.5", "SSL_CERT_DIR": "/certs"},
+				"binds": []interface{}{"/etc/ssl/internal:/certs:ro"},
+			},
+		}},
+		Labels: map[string]interface{}{
+			agentSpecLabel: `{"env": {"CATTLE_AGENT_IP": "192.168.1.5"}, "binds": ["agent-cache:/var/cache/agent"]}`,
+		},
+	}
+	spec, err := hostAgentSpec(host)
+	assert.Nil(err)
+	assert.Equal(&agentSpec{
+		Image: "registry.internal/rancher/agent:v2.0",
+		Env:   map[string]string{"CATTLE_AGENT_IP": "192.168.1.5", "SSL_CERT_DIR": "/certs"},
+		Binds: []string{"/etc/ssl/internal:/certs:ro", "agent-cache:/var/cache/agent"},
+	}, spec)
+
+	spec, err = hostAgentSpec(&v3.Host{})
+	assert.Nil(err)
+	assert.Equal(&agentSpec{}, spec)
+}
+
+func TestHostAgentSpecInvalid(t *testing.T) {
+	assert := require.New(t)
+
+	for _, label := range []string{
+		`{"env": `,
+		`{"image": "Invalid Image"}`,
+		`{"env": {"BAD-NAME": "1"}}`,
+		`{"env": {"CATTLE_PHYSICAL_HOST_UUID": "uuid2"}}`,
+		`{"binds": ["/data"]}`,
+		`{"binds": ["relative/path:/data"]}`,
+		`{"binds": ["/data:data"]}`,
+		`{"binds": ["/tmp/docker.sock:/var/run/docker.sock"]}`,
+		`{"binds": ["/a:/data", "/b:/data/"]}`,
+		`{"binds": ["/data:/data:rx"]}`,
+	} {
+		host := &v3.Host{Labels: map[string]interface{}{agentSpecLabel: label}}
+		_, err := hostAgentSpec(host)
+		assert.NotNil(err, label)
+	}
+}
+
+func TestAgentSpecMerge(t *testing.T) {
+	assert := require.New(t)
+
+	spec := &agentSpec{
+		Image: "rancher/agent",
+		Env:   map[string]string{"HTTP_PROXY": "http://agent-proxy:3128", "CATTLE_AGENT_IP": "10.0.0.5"},
+		Binds: []string{"/etc/ssl/internal:/certs:ro"},
+	}
+	repo, tag, err := spec.image("rancher/agent", "v2.0")
+	assert.Nil(err)
+	assert.Equal("rancher/agent:latest", repo+":"+tag)
+
+	config := buildContainerConfig([]string{"http://cattle:8080/v3/scripts/token"}, &v3.Host{Uuid: "uuid1"}, repo, tag)
+	config.Env = append(config.Env, "HTTP_PROXY=http://proxy:3128")
+	hostConfig := buildHostConfig()
+	spec.merge(config, hostConfig)
+	assert.Equal([]string{
+		"create", "--name", bootstrapContName, "--privileged", "--rm", "-i", "-t",
+		"-v", "/var/run/docker.sock:/var/run/docker.sock",
+		"-v", "/var/lib/rancher:/var/lib/rancher",
+		"-v", "/etc/ssl/internal:/certs:ro",
+		"-e", "CATTLE_PHYSICAL_HOST_UUID=uuid1",
+		"-e", "CATTLE_AGENT_IP=10.0.0.5",
+		"-e", "HTTP_PROXY=http://agent-proxy:3128",
+		"rancher/agent:latest",
+		"http://cattle:8080/v3/scripts/token",
+	}, dockerCreateArgs(config, hostConfig, bootstrapContName))
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+// machineBackend manages the machines of the machine dirs. Machines are always
+// created with docker-machine create, which also provisions their engine.
+type machineBackend interface {
+	// exists tells whether the machine dir holds the named machine.
+	exists(machineDir, name string) (bool, error)
+	// state returns the state of the machine as reported by its driver, such as Running.
+	state(machineDir, name string) (string, error)
+	// ip returns the IP of the machine its driver reports, usually the public one.
+	ip(machineDir, name string) (string, error)
+	// connectionConfig returns the endpoint and TLS files of the machine's docker engine.
+	connectionConfig(machineDir, name string) (*tlsConnectionConfig, error)
+	// remove removes the machine of the host, even if its driver fails to.
+	remove(machineDir string, host *v3.Host, correlationID string) error
+}
+
+var machines machineBackend = cliBackend{}
+
+func configureBackend(name string) {
+	switch name {
+	case config.MachineBackendNative:
+		machines = &nativeBackend{fallback: cliBackend{}}
+	default:
+		machines = cliBackend{}
+	}
+}
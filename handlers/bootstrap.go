@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"golang.org/x/net/context"
+)
+
+const (
+	// agentBootstrapLabel overrides the configured agent bootstrap of the host,
+	// such as io.rancher.host.agent.bootstrap=ssh. Host template labels apply too.
+	agentBootstrapLabel = "io.rancher.host.agent.bootstrap"
+	// tlsProbeTimeout bounds the ping of the docker API of the machine when
+	// the bootstrap is chosen automatically. A blocked port usually drops the
+	// connection rather than refusing it.
+	tlsProbeTimeout = 30 * time.Second
+)
+
+// agentBootstrap starts the agent container on a machine.
+type agentBootstrap interface {
+	// strategy is the config.AgentBootstrap* value of the bootstrap.
+	strategy() string
+	// pullImage pulls the image with auth, if set, calling progress, if set,
+	// with the percentage downloaded when the bootstrap reports it.
+	pullImage(ctx context.Context, imageRepo, imageTag string, auth *types.AuthConfig, progress func(int)) error
+	createContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, name string) (string, error)
+	startContainer(ctx context.Context, id string) error
+	// containerRunning returns whether a container of the name is running.
+	containerRunning(ctx context.Context, name string) (bool, error)
+	removeContainer(ctx context.Context, id string) error
+	// watch follows the events and the output of the named containers into d
+	// until ctx is done.
+	watch(ctx context.Context, names []string, d *agentDiagnostics)
+}
+
+// newAgentBootstrap returns the bootstrap of the host: the configured one,
+// overridden by its label. The automatic bootstrap uses the docker API of the
+// machine, unless it can't be reached and docker is run over ssh instead.
+func newAgentBootstrap(ctx context.Context, host *v3.Host, hostDir, correlationID string, log *logrus.Entry) (agentBootstrap, error) {
+	strategy := conf.AgentBootstrap
+	if value, ok := host.Labels[agentBootstrapLabel].(string); ok {
+		switch value {
+		case config.AgentBootstrapAuto, config.AgentBootstrapTLS, config.AgentBootstrapSSH:
+			strategy = value
+		default:
+			log.Warnf("Ignoring label %s: invalid bootstrap %q", agentBootstrapLabel, value)
+		}
+	}
+
+	ssh := &sshBootstrap{hostDir: hostDir, hostname: host.Hostname, correlationID: correlationID}
+	if strategy == config.AgentBootstrapSSH {
+		return ssh, nil
+	}
+
+	dockerClient, err := GetDockerClient(hostDir, host.Hostname)
+	if err == nil && strategy == config.AgentBootstrapAuto {
+		pingCtx, cancel := context.WithTimeout(ctx, tlsProbeTimeout)
+		_, err = dockerClient.Ping(pingCtx)
+		cancel()
+	}
+	if err != nil {
+		if strategy == config.AgentBootstrapAuto && ctx.Err() == nil {
+			log.Warnf("Docker API of the machine can't be reached, starting the agent over ssh: %v", err)
+			return ssh, nil
+		}
+		return nil, err
+	}
+	return &dockerBootstrap{client: dockerClient}, nil
+}
+
+// dockerBootstrap starts the agent through the docker API of the machine.
+type dockerBootstrap struct {
+	client *client.Client
+}
+
+func (b *dockerBootstrap) strategy() string {
+	return config.AgentBootstrapTLS
+}
+
+func (b *dockerBootstrap) pullImage(ctx context.Context, imageRepo, imageTag string, auth *types.AuthConfig, progress func(int)) error {
+	return pullImage(ctx, b.client, imageRepo, imageTag, auth, progress)
+}
+
+func (b *dockerBootstrap) createContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, name string) (string, error) {
+	resp, err := b.client.ContainerCreate(ctx, config, hostConfig, nil, name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (b *dockerBootstrap) startContainer(ctx context.Context, id string) error {
+	return b.client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (b *dockerBootstrap) containerRunning(ctx context.Context, name string) (bool, error) {
+	containers, err := b.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, c := range containers {
+		if len(c.Names) > 0 && c.Names[0] == "/"+name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *dockerBootstrap) removeContainer(ctx context.Context, id string) error {
+	return b.client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+}
+
+func (b *dockerBootstrap) watch(ctx context.Context, names []string, d *agentDiagnostics) {
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	for _, name := range names {
+		args.Add("container", name)
+	}
+	messages, errs := b.client.Events(ctx, types.EventsOptions{Filters: args})
+	for {
+		select {
+		case m := <-messages:
+			name := m.Actor.Attributes["name"]
+			switch m.Action {
+			case "start":
+				go b.followLogs(ctx, m.Actor.ID, name, d)
+			case "die":
+				exitCode, _ := strconv.Atoi(m.Actor.Attributes["exitCode"])
+				d.died(name, exitCode)
+			}
+		case err := <-errs:
+			if ctx.Err() == nil {
+				logger.Debugf("Stopped watching agent containers: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (b *dockerBootstrap) followLogs(ctx context.Context, id, name string, d *agentDiagnostics) {
+	info, err := b.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return
+	}
+	r, err := b.client.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Tail:       strconv.Itoa(agentLogLines),
+	})
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	var logs io.Reader = r
+	if info.Config == nil || !info.Config.Tty {
+		logs = &demuxReader{r: r}
+	}
+	scanLines(logs, func(line string) {
+		d.line(name, line)
+	})
+}
+
+// sshBootstrap starts the agent with the docker CLI of the machine, run over
+// docker-machine ssh, for machines whose docker API port is blocked.
+type sshBootstrap struct {
+	hostDir       string
+	hostname      string
+	correlationID string
+}
+
+func (b *sshBootstrap) strategy() string {
+	return config.AgentBootstrapSSH
+}
+
+// run runs the docker CLI on the machine with its output written to w,
+// killing it when ctx is done.
+func (b *sshBootstrap) run(ctx context.Context, w io.Writer, args ...string) error {
+	return b.runRemote(ctx, nil, w, "sudo docker "+shellQuote(args))
+}
+
+// runRemote runs the shell command on the machine, reading stdin if not nil,
+// with its output written to w, killing it when ctx is done.
+func (b *sshBootstrap) runRemote(ctx context.Context, stdin io.Reader, w io.Writer, remote string) error {
+	command := buildCommand(b.hostDir, []string{"ssh", b.hostname, remote})
+	setCorrelationID(command, b.correlationID)
+	command.Stdin = stdin
+	command.Stdout = w
+	command.Stderr = w
+	if err := command.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCommand(command)
+		case <-exited:
+		}
+	}()
+	err := command.Wait()
+	close(exited)
+	return err
+}
+
+// docker runs the docker CLI on the machine and returns its output.
+func (b *sshBootstrap) docker(ctx context.Context, args ...string) (string, error) {
+	var output bytes.Buffer
+	err := b.run(ctx, &output, args...)
+	out := strings.TrimSpace(output.String())
+	if err != nil {
+		return out, errors.Wrapf(err, "docker %s over ssh failed: %s", args[0], out)
+	}
+	return out, nil
+}
+
+// stream runs the docker CLI on the machine, calling fn with each line of its
+// output, until it exits or ctx is done.
+func (b *sshBootstrap) stream(ctx context.Context, fn func(string), args ...string) error {
+	r, w := io.Pipe()
+	go scanLines(r, fn)
+	err := b.run(ctx, w, args...)
+	w.Close()
+	return err
+}
+
+func (b *sshBootstrap) pullImage(ctx context.Context, imageRepo, imageTag string, auth *types.AuthConfig, progress func(int)) error {
+	image := imageRepo + ":" + imageTag
+	if auth == nil {
+		_, err := b.docker(ctx, "pull", image)
+		return err
+	}
+
+	// The password is written to the stdin of the ssh session, which docker
+	// login reads, so that it is part of no command line
+	var output bytes.Buffer
+	if err := b.runRemote(ctx, strings.NewReader(auth.Password), &output, loginPullCommand(image, auth)); err != nil {
+		return errors.Wrapf(err, "docker pull over ssh failed: %s", strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// loginPullCommand returns the shell command pulling the image with the
+// credentials, kept in a config dir of their own removed once the image is
+// pulled. The password is read from stdin.
+func loginPullCommand(image string, auth *types.AuthConfig) string {
+	login := shellQuote([]string{"login", "--username", auth.Username, "--password-stdin", auth.ServerAddress})
+	pull := shellQuote([]string{"pull", image})
+	return fmt.Sprintf(`d=$(mktemp -d) && sudo docker --config "$d" %s >/dev/null && sudo docker --config "$d" %s; rc=$?; sudo rm -rf "$d"; exit $rc`,
+		login, pull)
+}
+
+func (b *sshBootstrap) createContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, name string) (string, error) {
+	out, err := b.docker(ctx, dockerCreateArgs(config, hostConfig, name)...)
+	if err != nil {
+		return "", err
+	}
+	// The ID is the last line, after the output of an implicit pull
+	lines := strings.Split(out, "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
+func (b *sshBootstrap) startContainer(ctx context.Context, id string) error {
+	_, err := b.docker(ctx, "start", id)
+	return err
+}
+
+func (b *sshBootstrap) containerRunning(ctx context.Context, name string) (bool, error) {
+	out, err := b.docker(ctx, "ps", "--format", "{{.Names}}")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *sshBootstrap) removeContainer(ctx context.Context, id string) error {
+	_, err := b.docker(ctx, "rm", "-f", id)
+	return err
+}
+
+func (b *sshBootstrap) watch(ctx context.Context, names []string, d *agentDiagnostics) {
+	args := []string{"events", "--filter", "type=container"}
+	for _, name := range names {
+		args = append(args, "--filter", "container="+name)
+	}
+	args = append(args, "--format", "{{.Action}} {{.Actor.Attributes.name}} {{.Actor.Attributes.exitCode}}")
+	err := b.stream(ctx, func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		switch fields[0] {
+		case "start":
+			go b.stream(ctx, func(line string) {
+				d.line(fields[1], line)
+			}, "logs", "--follow", "--tail", strconv.Itoa(agentLogLines), fields[1])
+		case "die":
+			exitCode := 0
+			if len(fields) > 2 {
+				exitCode, _ = strconv.Atoi(fields[2])
+			}
+			d.died(fields[1], exitCode)
+		}
+	}, args...)
+	if err != nil && ctx.Err() == nil {
+		logger.Debugf("Stopped watching agent containers: %v", err)
+	}
+}
+
+// dockerCreateArgs returns the docker create arguments of the container built
+// by buildContainerConfig and buildHostConfig.
+func dockerCreateArgs(config *container.Config, hostConfig *container.HostConfig, name string) []string {
+	args := []string{"create", "--name", name}
+	if hostConfig.Privileged {
+		args = append(args, "--privileged")
+	}
+	if hostConfig.AutoRemove {
+		args = append(args, "--rm")
+	}
+	if config.AttachStdin {
+		args = append(args, "-i")
+	}
+	if config.Tty {
+		args = append(args, "-t")
+	}
+
+	bound := map[string]bool{}
+	for _, bind := range hostConfig.Binds {
+		args = append(args, "-v", bind)
+		if parts := strings.Split(bind, ":"); len(parts) > 1 {
+			bound[parts[1]] = true
+		}
+	}
+	volumes := []string{}
+	for volume := range config.Volumes {
+		if !bound[volume] {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		args = append(args, "-v", volume)
+	}
+
+	for _, env := range config.Env {
+		args = append(args, "-e", env)
+	}
+	args = append(args, config.Image)
+	return append(args, config.Cmd...)
+}
+
+// shellQuote quotes args for the shell running the ssh command on the machine.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = fmt.Sprintf("'%s'", strings.Replace(arg, "'", `'\''`, -1))
+	}
+	return strings.Join(quoted, " ")
+}
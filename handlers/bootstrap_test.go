@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	b64 "encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDockerCreateArgs(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{
+		Uuid:   "uuid1",
+		Labels: map[string]interface{}{"io.rancher.host.os": "linux"},
+	}
+	config := buildContainerConfig([]string{"http://cattle:8080/v3/scripts/token"}, host, "rancher/agent", "v2.0")
+	args := dockerCreateArgs(config, buildHostConfig(), bootstrapContName)
+	assert.Equal([]string{
+		"create", "--name", bootstrapContName, "--privileged", "--rm", "-i", "-t",
+		"-v", "/var/run/docker.sock:/var/run/docker.sock",
+		"-v", "/var/lib/rancher:/var/lib/rancher",
+		"-e", "CATTLE_PHYSICAL_HOST_UUID=uuid1",
+		"-e", "CATTLE_HOST_LABELS=io.rancher.host.os=linux",
+		"rancher/agent:v2.0",
+		"http://cattle:8080/v3/scripts/token",
+	}, args)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(`'ps' '--format' '{{.Names}}'`, shellQuote([]string{"ps", "--format", "{{.Names}}"}))
+	assert.Equal(`'-e' 'CATTLE_HOST_LABELS=a=it'\''s&b=2'`, shellQuote([]string{"-e", "CATTLE_HOST_LABELS=a=it's&b=2"}))
+}
+
+func TestAgentBootstrapLabel(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{
+		Hostname: "host1",
+		Labels:   map[string]interface{}{agentBootstrapLabel: "ssh"},
+	}
+	bootstrap, err := newAgentBootstrap(context.Background(), host, "/tmp/host1", "", logger.WithField("test", "TestAgentBootstrapLabel"))
+	assert.Nil(err)
+	assert.Equal(&sshBootstrap{hostDir: "/tmp/host1", hostname: "host1"}, bootstrap)
+}
+
+func TestLoginPullCommand(t *testing.T) {
+	assert := require.New(t)
+
+	auth := &types.AuthConfig{Username: "deploy", Password: "s3cr3t", ServerAddress: "registry.example.com"}
+	remote := loginPullCommand("registry.example.com/rancher/agent:v2.0", auth)
+	assert.Contains(remote, "'--password-stdin'")
+	encoded := b64.StdEncoding.EncodeToString([]byte(auth.Password))
+	for _, arg := range buildCommand("/tmp/host1", []string{"ssh", "host1", remote}).Args {
+		assert.False(strings.Contains(arg, auth.Password), arg)
+		assert.False(strings.Contains(arg, encoded), arg)
+	}
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	createOperation = "create"
+	removeOperation = "remove"
+)
+
+// checkpoint records a docker-machine process that was still running when the
+// service shut down, so that the next start can clean up after it.
+type checkpoint struct {
+	Operation string    `json:"operation"`
+	HostID    string    `json:"hostId"`
+	HostUUID  string    `json:"hostUuid"`
+	Hostname  string    `json:"hostname"`
+	HostDir   string    `json:"hostDir"`
+	Args      []string  `json:"args"`
+	Pid       int       `json:"pid"`
+	Time      time.Time `json:"time"`
+
+	command      *exec.Cmd
+	checkpointed bool
+}
+
+var runningCommands = struct {
+	sync.Mutex
+	commands map[*exec.Cmd]*checkpoint
+}{
+	commands: map[*exec.Cmd]*checkpoint{},
+}
+
+// parked is never closed. Handlers whose command was checkpointed block on it
+// so that they don't clean up the state the checkpoint refers to.
+var parked = make(chan struct{})
+
+// trackCommand registers a started docker-machine command. The returned func must
+// be called as soon as the command has been waited on.
+func trackCommand(operation string, host *v3.Host, hostDir string, command *exec.Cmd) func() {
+	cp := &checkpoint{
+		Operation: operation,
+		HostID:    host.Id,
+		HostUUID:  host.Uuid,
+		Hostname:  host.Hostname,
+		HostDir:   hostDir,
+		Args:      command.Args,
+		command:   command,
+	}
+	if command.Process != nil {
+		cp.Pid = command.Process.Pid
+	}
+
+	runningCommands.Lock()
+	runningCommands.commands[command] = cp
+	runningCommands.Unlock()
+
+	return func() {
+		runningCommands.Lock()
+		delete(runningCommands.commands, command)
+		checkpointed := cp.checkpointed
+		runningCommands.Unlock()
+
+		if checkpointed {
+			<-parked
+		}
+	}
+}
+
+// CheckpointRunningCommands writes a checkpoint for every docker-machine command
+// that is still running and then kills it along with its driver plugin.
+func CheckpointRunningCommands() error {
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+
+	var lastErr error
+	for _, cp := range runningCommands.commands {
+		cp.Time = time.Now()
+		cp.checkpointed = true
+		if err := writeCheckpoint(cp); err != nil {
+			lastErr = err
+		}
+
+		logger.WithFields(logrus.Fields{
+			"resourceId": cp.HostID,
+			"operation":  cp.Operation,
+			"pid":        cp.Pid,
+		}).Info("Checkpointed running docker-machine command")
+
+		if err := killCommand(cp.command); err != nil {
+			logger.Warnf("Failed to kill docker-machine command %v: %v", cp.Pid, err)
+		}
+	}
+	return lastErr
+}
+
+// RecoverCheckpoints cleans up after the docker-machine commands that were
+// interrupted by a previous shutdown. A machine that was still being created or
+// removed is removed, so that the redelivered provision starts from a clean host
+// dir. Hosts whose machine was fully created already carry their ExtractedConfig
+// and resume from it on the next provision.
+func RecoverCheckpoints() error {
+	files, err := filepath.Glob(filepath.Join(checkpointDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		cp, err := readCheckpoint(file)
+		if err != nil {
+			logger.Errorf("Failed to read checkpoint %s: %v", file, err)
+			continue
+		}
+
+		log := logger.WithFields(logrus.Fields{
+			"resourceId": cp.HostID,
+			"operation":  cp.Operation,
+			"machineDir": cp.HostDir,
+		})
+		log.Info("Recovering checkpointed docker-machine command")
+
+		host := &v3.Host{
+			Resource: v3.Resource{Id: cp.HostID},
+			Uuid:     cp.HostUUID,
+			Hostname: cp.Hostname,
+		}
+		if err := cleanupResources(cp.HostDir, host); err != nil {
+			log.Errorf("Failed to recover checkpoint: %v", err)
+			continue
+		}
+		os.RemoveAll(cp.HostDir)
+		os.Remove(file)
+	}
+
+	return nil
+}
+
+func checkpointDir() string {
+	return filepath.Join(getWorkDir(), "checkpoints")
+}
+
+func writeCheckpoint(cp *checkpoint) error {
+	if err := os.MkdirAll(checkpointDir(), 0740); err != nil {
+		return err
+	}
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	file := checkpointFile(cp)
+	return errors.Wrapf(ioutil.WriteFile(file, content, 0600), "Writing checkpoint %s", file)
+}
+
+// checkpointFile returns the file of the checkpoint, one per host and
+// operation, as a remove may run while the host is still being created.
+func checkpointFile(cp *checkpoint) string {
+	return filepath.Join(checkpointDir(), cp.HostUUID+"-"+cp.Operation+".json")
+}
+
+func readCheckpoint(file string) (*checkpoint, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	return cp, json.Unmarshal(content, cp)
+}
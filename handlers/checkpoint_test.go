@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	assert := require.New(t)
+
+	release := make(chan struct{})
+	handler := Track("host.provision", func(event *events.Event, apiClient *v3.RancherClient) error {
+		<-release
+		return nil
+	})
+	go handler(&events.Event{ResourceID: "1h1"}, nil)
+
+	// Give the handler a chance to start
+	time.Sleep(10 * time.Millisecond)
+	assert.False(Drain(10 * time.Millisecond))
+	assert.Equal(1, Running()["host.provision"])
+	assert.True(Handling("1h1"))
+	assert.False(Handling("1h2"))
+
+	close(release)
+	assert.True(Drain(time.Second))
+	assert.Empty(Running())
+	assert.False(Handling("1h1"))
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	workDir, err := ioutil.TempDir("", "gms-checkpoint")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+	defer Configure(config.Default())
+	c := config.Default()
+	c.MachineWorkDir = workDir
+	Configure(c)
+
+	host := &v3.Host{
+		Resource: v3.Resource{Id: "1h1"},
+		Uuid:     "uuid-1",
+		Hostname: "machine-1",
+	}
+	cp := &checkpoint{
+		Operation: createOperation,
+		HostID:    host.Id,
+		HostUUID:  host.Uuid,
+		Hostname:  host.Hostname,
+		HostDir:   "/tmp/machines/uuid-1",
+		Args:      []string{"docker-machine", "create"},
+	}
+	assert.Nil(writeCheckpoint(cp))
+	remove := *cp
+	remove.Operation = removeOperation
+	remove.Args = []string{"docker-machine", "rm", "-f", "machine-1"}
+	assert.Nil(writeCheckpoint(&remove))
+
+	read, err := readCheckpoint(filepath.Join(checkpointDir(), "uuid-1-create.json"))
+	assert.Nil(err)
+	assert.Equal(cp.HostID, read.HostID)
+	assert.Equal(cp.Hostname, read.Hostname)
+	assert.Equal(cp.HostDir, read.HostDir)
+	assert.Equal(cp.Args, read.Args)
+
+	// The remove does not overwrite the create of the same host
+	read, err = readCheckpoint(filepath.Join(checkpointDir(), "uuid-1-remove.json"))
+	assert.Nil(err)
+	assert.Equal(removeOperation, read.Operation)
+	assert.Equal(remove.Args, read.Args)
+}
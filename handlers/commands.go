@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"bufio"
+	"bytes"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"syscall"
 
 	v3 "github.com/rancher/go-rancher/v3"
 )
@@ -16,14 +18,20 @@ var (
 	RegExMachineDriverName  = regexp.MustCompile("^" + "MACHINE_PLUGIN_DRIVER_NAME=" + ".*")
 )
 
-func deleteMachine(hostDir string, host *v3.Host) error {
-	command := buildCommand(hostDir, []string{"rm", "-f", host.Hostname})
+// cliBackend manages machines by running docker-machine.
+type cliBackend struct{}
+
+func (cliBackend) remove(machineDir string, host *v3.Host, correlationID string) error {
+	command := buildCommand(machineDir, []string{"rm", "-f", host.Hostname})
+	setCorrelationID(command, correlationID)
 	err := command.Start()
 	if err != nil {
 		return err
 	}
 
+	untrack := trackCommand(removeOperation, host, machineDir, command)
 	err = command.Wait()
+	untrack()
 	if err != nil {
 		return err
 	}
@@ -31,13 +39,22 @@ func deleteMachine(hostDir string, host *v3.Host) error {
 	return nil
 }
 
-func getState(hostDir string, host *v3.Host) (string, error) {
-	command := buildCommand(hostDir, []string{"ls", "-f", "{{.State}}", host.Hostname})
+func (cliBackend) state(machineDir, name string) (string, error) {
+	command := buildCommand(machineDir, []string{"ls", "-f", "{{.State}}", name})
 	output, err := command.CombinedOutput()
 	return strings.TrimSpace(string(output)), err
 }
 
-func machineExists(machineDir string, name string) (bool, error) {
+func (cliBackend) ip(machineDir, name string) (string, error) {
+	command := buildCommand(machineDir, []string{"ip", name})
+	output, err := command.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (cliBackend) exists(machineDir, name string) (bool, error) {
 	command := buildCommand(machineDir, []string{"ls", "-q"})
 	r, err := command.StdoutPipe()
 	if err != nil {
@@ -68,13 +85,45 @@ func machineExists(machineDir string, name string) (bool, error) {
 	return false, nil
 }
 
+func (cliBackend) connectionConfig(machineDir, name string) (*tlsConnectionConfig, error) {
+	command := buildCommand(machineDir, []string{"config", name})
+	output, err := command.Output()
+	if err != nil {
+		return nil, err
+	}
+	args := string(bytes.TrimSpace(output))
+
+	connConfig, err := parseConnectionArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return connConfig, nil
+}
+
 func buildCommand(machineDir string, cmdArgs []string) *exec.Cmd {
-	command := exec.Command(machineCmd, cmdArgs...)
+	command := exec.Command(conf.DockerMachine, cmdArgs...)
 	env := initEnviron(machineDir)
 	command.Env = env
+	// Run in its own process group so the driver plugin can be killed with it
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	return command
 }
 
+// setCorrelationID passes the correlation ID of the event to docker-machine and its driver plugins.
+func setCorrelationID(command *exec.Cmd, correlationID string) {
+	if correlationID != "" {
+		command.Env = append(command.Env, correlationIDEnv+"="+correlationID)
+	}
+}
+
+func killCommand(command *exec.Cmd) error {
+	if command.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+}
+
 func initEnviron(machineDir string) []string {
 	env := os.Environ()
 	found := false
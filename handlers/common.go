@@ -4,21 +4,31 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
 	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
 	client "github.com/rancher/go-rancher/v3"
 )
 
 const (
-	machineDirEnvKey  = "MACHINE_STORAGE_PATH="
-	machineCmd        = "docker-machine"
-	defaultCattleHome = "/var/lib/cattle"
+	machineDirEnvKey = "MACHINE_STORAGE_PATH="
 )
 
+var conf = config.Default()
+
+// Configure sets the configuration used by the handlers. It must be called
+// before any event is handled.
+func Configure(c *config.Config) {
+	conf = c
+	configureAdmission(c.Admission)
+	configureBackend(c.MachineBackend)
+}
+
 func PingNoOp(event *events.Event, apiClient *client.RancherClient) error {
 	// No-op ping handler
 	return nil
@@ -29,15 +39,36 @@ func buildBaseHostDir(h *client.Host) (string, error) {
 	return machineDir, os.MkdirAll(machineDir, 0740)
 }
 
-func getWorkDir() string {
-	workDir := os.Getenv("MACHINE_WORK_DIR")
-	if workDir == "" {
-		workDir = os.Getenv("CATTLE_HOME")
-	}
-	if workDir == "" {
-		workDir = defaultCattleHome
+var hostDirHolds = struct {
+	sync.Mutex
+	count map[string]int
+}{count: map[string]int{}}
+
+// holdHostDir keeps the host dir until the returned release, and those of the
+// other holds of the dir, are called. The last release removes the dir, so
+// that background work on the machine can outlive its handler.
+func holdHostDir(hostDir string) func() {
+	hostDirHolds.Lock()
+	defer hostDirHolds.Unlock()
+	hostDirHolds.count[hostDir]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hostDirHolds.Lock()
+			defer hostDirHolds.Unlock()
+			hostDirHolds.count[hostDir]--
+			if hostDirHolds.count[hostDir] > 0 {
+				return
+			}
+			delete(hostDirHolds.count, hostDir)
+			os.RemoveAll(hostDir)
+		})
 	}
-	return filepath.Join(workDir, "machine")
+}
+
+func getWorkDir() string {
+	return conf.WorkDir()
 }
 
 var publishReply = func(reply *client.Publish, apiClient *client.RancherClient) error {
@@ -45,15 +76,18 @@ var publishReply = func(reply *client.Publish, apiClient *client.RancherClient)
 	return err
 }
 
-var publishTransitioningReply = func(msg string, event *events.Event, apiClient *client.RancherClient) {
+var publishTransitioningReply = func(status progressStatus, event *events.Event, apiClient *client.RancherClient) {
 	// Since this is only updating the msg for the state transition, we will ignore errors here
 	replyT := newReply(event)
 	replyT.Transitioning = "yes"
-	replyT.TransitioningMessage = msg
+	replyT.TransitioningMessage = status.Message
+	replyT.Data = map[string]interface{}{
+		"progress": status,
+	}
 	publishReply(replyT, apiClient)
 }
 
-func republishTransitioningReply(publishChan <-chan string, event *events.Event, apiClient *client.RancherClient) {
+func republishTransitioningReply(publishChan <-chan progress, event *events.Event, apiClient *client.RancherClient) {
 	// We only do this because there is a current issue within Cattle that if a transition message
 	// has not been updated for a period of time, it can no longer be updated.  For now, to deal with this
 	// we will simply republish transitioning messages until the next one is added.
@@ -61,21 +95,21 @@ func republishTransitioningReply(publishChan <-chan string, event *events.Event,
 	// In all likelihood, we will remove this method later.
 	defaultWaitTime := time.Second * 5
 	ticker := time.NewTicker(defaultWaitTime)
-	var lastMsg string
+	var status progressStatus
 	for {
 		select {
-		case msg, more := <-publishChan:
+		case p, more := <-publishChan:
 			if !more {
 				ticker.Stop()
 				return
 			}
-			lastMsg = msg
-			publishTransitioningReply(lastMsg, event, apiClient)
+			status = status.advance(p)
+			publishTransitioningReply(status, event, apiClient)
 
 		case <-ticker.C:
 			//republish last message
-			if lastMsg != "" {
-				publishTransitioningReply(lastMsg, event, apiClient)
+			if status.Message != "" {
+				publishTransitioningReply(status, event, apiClient)
 			}
 		}
 	}
@@ -198,16 +232,16 @@ func newReply(event *events.Event) *client.Publish {
 	}
 }
 
-func cleanupResources(machineDir, name string) error {
+func cleanupResources(machineDir string, host *client.Host) error {
 	logger.WithFields(logrus.Fields{
-		"machine name": name,
+		"machine name": host.Hostname,
 	}).Info("starting cleanup...")
 	dExists, err := dirExists(machineDir)
 	if !dExists {
 		return nil
 	}
 
-	mExists, err := machineExists(machineDir, name)
+	mExists, err := machines.exists(machineDir, host.Hostname)
 	if err != nil {
 		return err
 	}
@@ -216,22 +250,14 @@ func cleanupResources(machineDir, name string) error {
 		return nil
 	}
 
-	command := buildCommand(machineDir, []string{"rm", "-f", name})
-
-	err = command.Start()
-	if err != nil {
-		return err
-	}
-
-	err = command.Wait()
-	if err != nil {
+	if err := machines.remove(machineDir, host, ""); err != nil {
 		return err
 	}
 
 	os.RemoveAll(machineDir)
 
 	logger.WithFields(logrus.Fields{
-		"machine name": name,
+		"machine name": host.Hostname,
 	}).Info("cleanup successful")
 	return nil
 }
@@ -11,11 +11,9 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"bytes"
-
-	"io/ioutil"
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
@@ -26,6 +24,7 @@ import (
 	"github.com/docker/go-connections/tlsconfig"
 	"github.com/pkg/errors"
 	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
 	"github.com/rancher/go-machine-service/handlers/providers"
 	v3 "github.com/rancher/go-rancher/v3"
 	"golang.org/x/net/context"
@@ -43,14 +42,15 @@ var regExHyphen = regexp.MustCompile("([a-z])([A-Z])")
 
 var endpointRegEx = regexp.MustCompile("-H=[[:alnum:]]*[[:graph:]]*")
 
-func CreateMachineAndActivateMachine(event *events.Event, apiClient *v3.RancherClient) error {
-	log := logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-	})
+func CreateMachineAndActivateMachine(event *events.Event, apiClient *v3.RancherClient) (err error) {
+	log := eventLogger(event)
+
+	// Registered first so that a remove waiting for it runs after the machine dir is removed
+	op := operations.start(event.ResourceID, createOperation)
+	defer op.finish()
 
 	//Setup republishing timer
-	publishChan := make(chan string, 10)
+	publishChan := make(chan progress, 10)
 	go republishTransitioningReply(publishChan, event, apiClient)
 	defer close(publishChan)
 
@@ -58,7 +58,27 @@ func CreateMachineAndActivateMachine(event *events.Event, apiClient *v3.RancherC
 	if err != nil || host == nil {
 		return err
 	}
-	defer os.RemoveAll(hostDir)
+	defer holdHostDir(hostDir)()
+
+	// Losing the lease cancels the provisioning, which is left to the new holder
+	hostLease, err := acquireLease(host, apiClient, op.cancel)
+	if err == errLeaseHeld {
+		log.Info("Host is leased by another instance, skipping provision")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer hostLease.release(false)
+	defer func() {
+		if err != nil && hostLease.isLost() {
+			log.Warnf("Lost host lease to another instance, leaving the provision to it: %v", err)
+			err = nil
+		}
+	}()
+
+	defer func() {
+		recordOutcome(provisionTotal, host.Driver, err)
+	}()
 	// first check if host is already created. If so we restore the config
 	restored, err := isHostAlreadyCreated(host, hostDir)
 	if err != nil {
@@ -66,11 +86,14 @@ func CreateMachineAndActivateMachine(event *events.Event, apiClient *v3.RancherC
 	}
 
 	if !restored {
-		if err := createMachine(event, apiClient, publishChan, log); err != nil {
+		if err := createMachine(event, apiClient, publishChan, log, op); err != nil {
 			return err
 		}
 	}
-	if err := registerRancherAgent(event, apiClient, publishChan); err != nil {
+	if err := runPostCreateHooks(event, apiClient, publishChan, log, op); err != nil {
+		return err
+	}
+	if err := registerRancherAgent(event, apiClient, publishChan, log, op); err != nil {
 		return err
 	}
 	if err := touchBootstrappedStamp(hostDir, host); err != nil {
@@ -80,22 +103,30 @@ func CreateMachineAndActivateMachine(event *events.Event, apiClient *v3.RancherC
 	return publishReply(newReply(event), apiClient)
 }
 
-func createMachine(event *events.Event, apiClient *v3.RancherClient, publishChan chan string, log *logrus.Entry) error {
+func createMachine(event *events.Event, apiClient *v3.RancherClient, publishChan chan progress, log *logrus.Entry, op *operation) error {
 	log.Info("Creating Host")
+	span := eventSpan(event)
 	machineCreated := false
 	host, hostDir, err := getHostAndHostDir(event, apiClient)
 	if err != nil || host == nil {
 		return err
 	}
-	if err := applyHostTemplate(host, apiClient); err != nil {
+	step := span.Child("applyHostTemplate")
+	err = applyHostTemplate(host, apiClient)
+	step.Finish(err)
+	if err != nil {
+		return err
+	}
+	if err := validateAgentSettings(host); err != nil {
 		return err
 	}
 	if _, err := os.Stat(createdStamp(hostDir, host)); !os.IsNotExist(err) {
 		return publishReply(newReply(event), apiClient)
 	}
 	defer func() {
-		if !machineCreated {
-			cleanupResources(hostDir, host.Hostname)
+		// A canceled create is left to the remove that canceled it
+		if !machineCreated && !op.canceled() {
+			cleanupResources(hostDir, host)
 		}
 	}()
 
@@ -105,42 +136,127 @@ func createMachine(event *events.Event, apiClient *v3.RancherClient, publishChan
 	}
 	driver := hostTemplate.Driver
 
+	release, admitted := admit(driver, hostTemplate.Id, op.ctx.Done(), func(position int) {
+		publishChan <- progress{phaseQueued, fmt.Sprintf("Queued (position %d)", position)}
+	})
+	if !admitted {
+		return errProvisionCanceled
+	}
+	defer release()
+
 	providerHandler := providers.GetProviderHandler(driver)
-	if err := providerHandler.HandleCreate(host, hostDir); err != nil {
+	step = span.Child("HandleCreate")
+	step.SetAttribute("driver", driver)
+	err = providerHandler.HandleCreate(host, hostDir, log)
+	step.Finish(err)
+	if err != nil {
+		return err
+	}
+	if err := applyUserData(host, hostDir, driver, log); err != nil {
+		return err
+	}
+
+	attempts := 0
+	err = provisionPolicy(host, config.PhaseMachineCreate, log).run(op.ctx, func(ctx context.Context) error {
+		attempts++
+		if attempts > 1 {
+			// Remove what the failed attempt created before trying again
+			cleanupResources(hostDir, host)
+			publishChan <- progress{phaseContactingDriver, fmt.Sprintf("Retrying to create the machine (attempt %d)", attempts)}
+		}
+		return runMachineCreate(ctx, event, host, hostDir, driver, publishChan, log, op, providerHandler)
+	})
+	if err == errProvisionCanceled {
+		// Keep what docker-machine created so far for the remove to delete
+		log.Info("Machine create canceled, saving machine config for removal")
+		if err := saveExtractedConfig(context.Background(), hostDir, host, apiClient, log); err != nil {
+			log.Errorf("Failed to save config of canceled machine: %v", err)
+		}
+		return err
+	}
+	if err != nil {
 		return err
 	}
 
+	log.Info("Machine Created")
+	machineCreated = true
+	touchCreatedStamp(hostDir, host)
+
+	if err := saveExtractedConfig(op.ctx, hostDir, host, apiClient, log); err != nil {
+		return err
+	}
+	log.Info("Machine config file saved.")
+	return nil
+}
+
+// runMachineCreate runs docker-machine create once, killing it when ctx is done.
+func runMachineCreate(ctx context.Context, event *events.Event, host *v3.Host, hostDir, driver string, publishChan chan progress,
+	log *logrus.Entry, op *operation, providerHandler providers.Provider) error {
 	command, err := buildCreateCommand(host, hostDir, driver)
 	if err != nil {
 		return err
 	}
+	setCorrelationID(command, correlationID(event))
 
-	publishChan <- "Contacting " + driver
+	publishChan <- progress{phaseContactingDriver, "Contacting " + driver}
+	phaseStart := time.Now()
+	step := eventSpan(event).Child("docker-machine create")
+	step.SetAttribute("driver", driver)
 
 	readerStdout, readerStderr, err := startReturnOutput(command)
 	if err != nil {
+		step.Finish(err)
 		return err
 	}
 
+	untrack := trackCommand(createOperation, host, hostDir, command)
+	op.setCommand(command)
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCommand(command)
+		case <-exited:
+		}
+	}()
+
+	t, err := openTranscript(host.Id, command.Args)
+	if err != nil {
+		log.Warnf("Failed to open provisioning log: %v", err)
+	}
+	defer t.Close()
+	t.Printf("gms", "Running %s", strings.Join(command.Args, " "))
+
 	errChan := make(chan string, 1)
-	go logProgress(readerStdout, readerStderr, publishChan, host, event, errChan, providerHandler)
+	go logProgress(readerStdout, readerStderr, publishChan, host, log, errChan, providerHandler, t)
 
-	if err := command.Wait(); err != nil {
+	err = command.Wait()
+	if err != nil {
+		t.Printf("gms", "docker-machine create failed: %v", err)
+	} else {
+		t.Printf("gms", "docker-machine create succeeded")
+	}
+	close(exited)
+	op.setCommand(nil)
+	untrack()
+	step.Finish(err)
+	provisionPhaseDuration.Since(phaseStart, driver, phaseContactingDriver)
+	if err != nil && ctx.Err() == nil {
 		select {
 		case errString := <-errChan:
 			if errString != "" {
-				return fmt.Errorf(errString)
+				return &driverError{msg: errString}
 			}
 		case <-time.After(10 * time.Second):
 			log.Error("Waited 10 seconds to break after command.Wait().  Please review logProgress.")
 		}
-		return err
 	}
+	return err
+}
 
-	log.Info("Machine Created")
-	machineCreated = true
-	touchCreatedStamp(hostDir, host)
-
+// saveExtractedConfig uploads the machine dir to the host, from which it is
+// restored to reprovision or remove the machine.
+func saveExtractedConfig(ctx context.Context, hostDir string, host *v3.Host, apiClient *v3.RancherClient, log *logrus.Entry) error {
 	destFile, err := createExtractedConfig(hostDir, host)
 	if err != nil {
 		return err
@@ -151,138 +267,157 @@ func createMachine(event *events.Event, apiClient *v3.RancherClient, publishChan
 		return err
 	}
 
-	for i := 0; i < 100; i++ {
-		_, err = apiClient.Host.Update(host, &v3.Host{
+	return provisionPolicy(host, config.PhaseSaveConfig, log).run(ctx, func(ctx context.Context) error {
+		_, err := apiClient.Host.Update(host, &v3.Host{
 			ExtractedConfig: extractedConf,
 		})
-		if err == nil {
-			break
-		}
-	}
-	log.Info("Machine config file saved.")
-	return nil
+		return err
+	})
 }
 
-func registerRancherAgent(event *events.Event, apiClient *v3.RancherClient, publishChan chan string) error {
-	logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-	}).Info("Activating Machine")
+func registerRancherAgent(event *events.Event, apiClient *v3.RancherClient, publishChan chan progress, log *logrus.Entry, op *operation) error {
+	if op.canceled() {
+		return errProvisionCanceled
+	}
+	log.Info("Activating Machine")
+	span := eventSpan(event)
 
-	publishChan <- "Installing Rancher agent"
+	publishChan <- progress{phaseInstallingAgent, "Installing Rancher agent"}
+	phaseStart := time.Now()
 	host, hostDir, err := getHostAndHostDir(event, apiClient)
 	if err != nil || host == nil {
 		return err
 	}
+	// The template values, such as the proxy, also apply to the agent
+	if err := applyHostTemplate(host, apiClient); err != nil {
+		return err
+	}
 
 	registrationURL, imageRepo, imageTag, err := getRegistrationURLAndImage(host.ClusterId, apiClient)
 	if err != nil {
 		return err
 	}
+	spec, err := hostAgentSpec(host)
+	if err != nil {
+		return err
+	}
+	imageRepo, imageTag, err = spec.image(imageRepo, imageTag)
+	if err != nil {
+		return err
+	}
+	// An agent IP set by the spec wins over the one of the policy
+	if _, ok := spec.Env[agentIPEnv]; !ok {
+		agentIP, err := resolveAgentIP(host, hostDir, log)
+		if err != nil {
+			return err
+		}
+		if agentIP != "" {
+			host.AgentIpAddress = agentIP
+			if err := reportAgentIP(host, agentIP, apiClient); err != nil {
+				return errors.Wrapf(err, "Reporting agent IP %s", agentIP)
+			}
+		}
+	}
 
-	dockerClient, err := GetDockerClient(hostDir, host.Hostname)
+	step := span.Child("agentBootstrap")
+	bootstrap, err := newAgentBootstrap(op.ctx, host, hostDir, correlationID(event), log)
+	step.Finish(err)
 	if err != nil {
 		return err
 	}
+	span.SetAttribute("agentBootstrap", bootstrap.strategy())
 
-	err = pullImage(dockerClient, imageRepo, imageTag)
+	auths, err := resolveRegistryAuths(host, apiClient)
 	if err != nil {
 		return err
 	}
 
-	publishChan <- "Creating agent container"
+	step = span.Child("pullImage")
+	step.SetAttribute("image", imageRepo+":"+imageTag)
+	err = bootstrap.pullImage(op.ctx, imageRepo, imageTag, auths.forImage(imageRepo), nil)
+	step.Finish(err)
+	if err != nil {
+		return err
+	}
+
+	// Follow the agent containers from the start, the bootstrap container
+	// removes itself once it exits
+	diagnostics := newAgentDiagnostics(registrationURL)
+	watchCtx, stopWatch := context.WithCancel(op.ctx)
+	defer stopWatch()
+	go bootstrap.watch(watchCtx, []string{bootstrapContName, agentContName}, diagnostics)
+
+	publishChan <- progress{message: "Creating agent container"}
 
-	contID, err := createContainer(registrationURL, host, dockerClient, imageRepo, imageTag)
+	step = span.Child("ContainerCreate")
+	contID, err := createContainer(op.ctx, registrationURL, host, bootstrap, spec, imageRepo, imageTag)
+	step.Finish(err)
 	if err != nil {
 		return err
 	}
-	logger.WithFields(logrus.Fields{
-		"resourceId":  event.ResourceID,
+	log.WithFields(logrus.Fields{
 		"machineId":   host.Id,
 		"containerId": contID,
+		"bootstrap":   bootstrap.strategy(),
 	}).Info("Container created for machine")
 
-	publishChan <- "Starting agent container"
+	publishChan <- progress{message: "Starting agent container"}
 
-	err = dockerClient.ContainerStart(context.Background(), contID, types.ContainerStartOptions{})
+	step = span.Child("ContainerStart")
+	err = bootstrap.startContainer(op.ctx, contID)
+	step.Finish(err)
 	if err != nil {
 		return err
 	}
 
-	found := false
-	for i := 0; i < 30; i++ {
-		containers, err := dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
+	err = provisionPolicy(host, config.PhaseAgentContainer, log).run(op.ctx, func(ctx context.Context) error {
+		running, err := bootstrap.containerRunning(ctx, agentContName)
 		if err != nil {
 			return err
 		}
-		for _, c := range containers {
-			if len(c.Names) > 0 && c.Names[0] == "/rancher-agent" {
-				found = true
-				break
-			}
+		if !running {
+			return errAgentContainerNotFound
 		}
-		time.Sleep(2 * time.Second)
+		return nil
+	})
+	if err != nil {
+		err = agentFailed(host.Id, diagnostics, err)
+		log.WithField("machineId", host.Id).Errorf("Agent bootstrap failed: %v", err)
+		return err
 	}
 
-	if !found {
-		logger.WithFields(logrus.Fields{
-			"resourceId": event.ResourceID,
-			"machineId":  host.Id,
-		}).Error("Failed to find rancher-agent container")
-		return errors.New("Failed to find rancher-agent container")
-	}
+	startImagePrePull(host, hostDir, bootstrap, auths, apiClient, log)
 
-	go func() {
-		accountID, err := getAccountID(host, apiClient)
-		if err != nil {
-			return
-		}
+	provisionPhaseDuration.Since(phaseStart, host.Driver, phaseInstallingAgent)
+	publishChan <- progress{phaseWaitingForAgent, "Waiting for agent initialization"}
+	phaseStart = time.Now()
+	step = span.Child("waitForAgent")
 
-		images, err := collectImageNames(accountID, apiClient)
-		if err != nil {
-			return
-		}
-		for _, image := range images {
-			repo, tag, err := parseImage(image)
-			if err != nil {
-				continue
-			}
-			logger.WithFields(logrus.Fields{
-				"resourceId":        event.ResourceID,
-				"machineExternalId": host.Uuid,
-				"repo":              repo,
-				"tag":               tag,
-			}).Info("Pulling image")
-			go pullImage(dockerClient, repo, tag)
-		}
-	}()
-
-	publishChan <- "Waiting for agent initialization"
-
-	foundAgentID := false
-	for i := 0; i < 150; i++ {
+	err = provisionPolicy(host, config.PhaseAgentRegistration, log).run(op.ctx, func(ctx context.Context) error {
 		host, err := apiClient.Host.ById(host.Id)
 		if err != nil {
-			logrus.Errorf("failed to get host. err: %v", err)
-			continue
+			log.Errorf("failed to get host. err: %v", err)
+			return err
 		}
-		if host.AgentId != "" {
-			foundAgentID = true
-			break
+		if host == nil || host.AgentId == "" {
+			return errAgentNotRegistered
 		}
-		time.Sleep(2 * time.Second)
-	}
+		return nil
+	})
+	provisionPhaseDuration.Since(phaseStart, host.Driver, phaseWaitingForAgent)
 
-	if !foundAgentID {
-		logrus.Errorf("host is not registered correctly. ResourceId: %v, hostId: %v", event.ResourceID, host.Id)
-		return errors.New("Host is not registered correctly")
+	if err != nil {
+		step.Finish(err)
+		err = agentFailed(host.Id, diagnostics, err)
+		log.Errorf("host is not registered correctly. hostId: %v: %v", host.Id, err)
+		return err
 	}
+	step.Finish(nil)
 
 	// swallow the error as we don't care if it is deleted or not
-	dockerClient.ContainerRemove(context.Background(), contID, types.ContainerRemoveOptions{Force: true})
+	bootstrap.removeContainer(context.Background(), contID)
 
-	logger.WithFields(logrus.Fields{
-		"resourceId":        event.ResourceID,
+	log.WithFields(logrus.Fields{
 		"machineExternalId": host.Uuid,
 		"containerId":       contID,
 	}).Info("Rancher-agent for machine started")
@@ -297,7 +432,7 @@ func isHostAlreadyCreated(host *v3.Host, hostDir string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	mExists, err := machineExists(hostDir, host.Hostname)
+	mExists, err := machines.exists(hostDir, host.Hostname)
 	if err != nil {
 		return false, err
 	}
@@ -325,28 +460,35 @@ func getAccountID(host *v3.Host, apiClient *v3.RancherClient) (string, error) {
 	return accounts.Data[0].Id, nil
 }
 
-func logProgress(readerStdout io.Reader, readerStderr io.Reader, publishChan chan<- string, host *v3.Host, event *events.Event, errChan chan<- string, providerHandler providers.Provider) {
-	// We will just logging stdout first, then stderr, ignoring all errors.
-	defer close(errChan)
-	scanner := bufio.NewScanner(readerStdout)
-	for scanner.Scan() {
-		msg := scanner.Text()
-		logger.WithFields(logrus.Fields{
-			"resourceId: ": event.ResourceID,
-		}).Infof("stdout: %s", msg)
-		transitionMsg := filterDockerMessage(msg, host, errChan, providerHandler, false)
-		if transitionMsg != "" {
-			publishChan <- transitionMsg
+func logProgress(readerStdout io.Reader, readerStderr io.Reader, publishChan chan<- progress, host *v3.Host, log *logrus.Entry, errChan chan<- string, providerHandler providers.Provider, t *transcript) {
+	// Both streams are read at once so that the transcript interleaves them, ignoring all errors.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(readerStdout)
+		for scanner.Scan() {
+			msg := scanner.Text()
+			log.Infof("stdout: %s", msg)
+			t.Printf("stdout", "%s", msg)
+			transitionMsg := filterDockerMessage(msg, host, errChan, providerHandler, false)
+			if transitionMsg != "" {
+				publishChan <- progress{machinePhase(transitionMsg), transitionMsg}
+			}
 		}
-	}
-	scanner = bufio.NewScanner(readerStderr)
-	for scanner.Scan() {
-		msg := scanner.Text()
-		logger.WithFields(logrus.Fields{
-			"resourceId": event.ResourceID,
-		}).Infof("stderr: %s", msg)
-		filterDockerMessage(msg, host, errChan, providerHandler, true)
-	}
+	}()
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(readerStderr)
+		for scanner.Scan() {
+			msg := scanner.Text()
+			log.Infof("stderr: %s", msg)
+			t.Printf("stderr", "%s", msg)
+			filterDockerMessage(msg, host, errChan, providerHandler, true)
+		}
+	}()
+	wg.Wait()
+	close(errChan)
 }
 
 func filterDockerMessage(msg string, host *v3.Host, errChan chan<- string, providerHandler providers.Provider, errMsg bool) string {
@@ -398,22 +540,23 @@ func buildMachineCreateCmd(host *v3.Host, driver string) ([]string, error) {
 	cmd = append(cmd, buildEngineOpts("--engine-install-url", []string{host.EngineInstallUrl})...)
 	cmd = append(cmd, buildEngineOpts("--engine-opt", mapToSlice(host.EngineOpt))...)
 	cmd = append(cmd, buildEngineOpts("--engine-env", mapToSlice(host.EngineEnv))...)
+	cmd = append(cmd, buildEngineOpts("--engine-env", proxyEngineEnv(host))...)
 	cmd = append(cmd, buildEngineOpts("--engine-insecure-registry", host.EngineInsecureRegistry)...)
 	cmd = append(cmd, buildEngineOpts("--engine-label", mapToSlice(host.EngineLabel))...)
 	cmd = append(cmd, buildEngineOpts("--engine-registry-mirror", host.EngineRegistryMirror)...)
 	cmd = append(cmd, buildEngineOpts("--engine-storage-driver", []string{host.EngineStorageDriver})...)
 
 	// Grab the reflected Value of XyzConfig (i.e. DigitaloceanConfig) based on the machine driver
-	driverConfig := host.Data["fields"].(map[string]interface{})[driver+"Config"]
-	if driverConfig == nil {
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	driverMapConfig, ok := fields[driver+"Config"].(map[string]interface{})
+	if !ok {
 		return nil, fmt.Errorf("%vConfig does not exist on Machine %v", host.Driver, host.Id)
 	}
 	configFields := []string{}
-	for k := range driverConfig.(map[string]interface{}) {
+	for k := range driverMapConfig {
 		configFields = append(configFields, k)
 	}
 	sort.Strings(configFields)
-	driverMapConfig := driverConfig.(map[string]interface{})
 	for _, nameConfigField := range configFields {
 		// We are ignoring the Resource Field as we don't need it.
 		if nameConfigField == "Resource" {
@@ -487,17 +630,18 @@ func touchCreatedStamp(base string, machine *v3.Host) error {
 	return nil
 }
 
-func createContainer(registrationURL string, host *v3.Host,
-	dockerClient *client.Client, imageRepo, imageTag string) (string, error) {
+func createContainer(ctx context.Context, registrationURL string, host *v3.Host,
+	bootstrap agentBootstrap, spec *agentSpec, imageRepo, imageTag string) (string, error) {
 	containerCmd := []string{registrationURL}
 	containerConfig := buildContainerConfig(containerCmd, host, imageRepo, imageTag)
 	hostConfig := buildHostConfig()
+	spec.merge(containerConfig, hostConfig)
 
-	resp, err := dockerClient.ContainerCreate(context.Background(), containerConfig, hostConfig, nil, bootstrapContName)
+	id, err := bootstrap.createContainer(ctx, containerConfig, hostConfig, bootstrapContName)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to create bootstrap container")
 	}
-	return resp.ID, nil
+	return id, nil
 }
 
 func buildHostConfig() *container.HostConfig {
@@ -521,6 +665,9 @@ func buildContainerConfig(containerCmd []string, host *v3.Host, imgRepo, imgTag
 		"/var/lib/rancher":     {},
 	}
 	envVars := []string{"CATTLE_PHYSICAL_HOST_UUID=" + host.Uuid}
+	if host.AgentIpAddress != "" {
+		envVars = append(envVars, agentIPEnv+"="+host.AgentIpAddress)
+	}
 	labelVars := []string{}
 	for key, value := range host.Labels {
 		label := ""
@@ -538,6 +685,7 @@ func buildContainerConfig(containerCmd []string, host *v3.Host, imgRepo, imgTag
 		labelVarsString = "CATTLE_HOST_LABELS=" + labelVarsString
 		envVars = append(envVars, labelVarsString)
 	}
+	envVars = append(envVars, hostProxy(host).Env()...)
 	config := &container.Config{
 		AttachStdin: true,
 		Tty:         true,
@@ -549,18 +697,22 @@ func buildContainerConfig(containerCmd []string, host *v3.Host, imgRepo, imgTag
 	return config
 }
 
-func pullImage(dockerClient *client.Client, imageRepo, imageTag string) error {
+// pullImage pulls the image with auth, if set, calling progress, if set, with
+// the percentage of its layers downloaded.
+func pullImage(ctx context.Context, dockerClient *client.Client, imageRepo, imageTag string, auth *types.AuthConfig, progress func(int)) error {
 	logger.Printf("pulling %v:%v image.", imageRepo, imageTag)
-	reader, err := dockerClient.ImagePull(context.Background(), fmt.Sprintf("%s:%s", imageRepo, imageTag), types.ImagePullOptions{})
+	registryAuth, err := encodeRegistryAuth(auth)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
-	_, err = ioutil.ReadAll(reader)
+	reader, err := dockerClient.ImagePull(ctx, fmt.Sprintf("%s:%s", imageRepo, imageTag), types.ImagePullOptions{
+		RegistryAuth: registryAuth,
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	defer reader.Close()
+	return decodePullStream(reader, progress)
 }
 
 var getRegistrationURLAndImage = func(clusterId string, apiClient *v3.RancherClient) (string, string, string, error) {
@@ -574,7 +726,7 @@ var getRegistrationURLAndImage = func(clusterId string, apiClient *v3.RancherCli
 	}
 
 	regURL := cluster.RegistrationToken.RegistrationUrl
-	repo, tag, err := parseImage(cluster.RegistrationToken.Image)
+	repo, tag, err := parseImage(rewriteImage(cluster.RegistrationToken.Image))
 	if err != nil {
 		return "", "", "", fmt.Errorf("invalid Image format in token %s", cluster.RegistrationToken.Image)
 	}
@@ -588,7 +740,7 @@ func tweakRegistrationURL(regURL string) string {
 	// We do this to accomodate end-to-end workflow in our local development environments.
 	// Containers running in a vm won't be able to reach an api running on "localhost"
 	// because typically that localhost is referring to the real computer, not the vm.
-	localHostReplace := os.Getenv("CATTLE_AGENT_LOCALHOST_REPLACE")
+	localHostReplace := conf.AgentLocalhostReplace
 	if localHostReplace == "" {
 		return regURL
 	}
@@ -606,19 +758,19 @@ type tlsConnectionConfig struct {
 
 // GetDockerClient Returns a TLS-enabled docker client for the specified machine.
 func GetDockerClient(machineDir string, machineName string) (*client.Client, error) {
-	conf, err := getConnectionConfig(machineDir, machineName)
+	conf, err := machines.connectionConfig(machineDir, machineName)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting connection config: %v", err)
 	}
 	return newTLSDockerClient(conf)
 }
 
-func newTLSDockerClient(conf *tlsConnectionConfig) (*client.Client, error) {
+func newTLSDockerClient(connConfig *tlsConnectionConfig) (*client.Client, error) {
 	options := tlsconfig.Options{
-		CAFile:             conf.caCert,
-		CertFile:           conf.cert,
-		KeyFile:            conf.key,
-		InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == "",
+		CAFile:             connConfig.caCert,
+		CertFile:           connConfig.cert,
+		KeyFile:            connConfig.key,
+		InsecureSkipVerify: !conf.DockerTLSVerify,
 	}
 	tlsc, err := tlsconfig.Client(options)
 	if err != nil {
@@ -631,7 +783,7 @@ func newTLSDockerClient(conf *tlsConnectionConfig) (*client.Client, error) {
 		},
 	}
 
-	host := conf.endpoint
+	host := connConfig.endpoint
 	version := defaultVersion
 
 	cli, err := client.NewClient(host, version, httpClient, nil)
@@ -641,22 +793,6 @@ func newTLSDockerClient(conf *tlsConnectionConfig) (*client.Client, error) {
 	return cli, nil
 }
 
-func getConnectionConfig(machineDir string, machineName string) (*tlsConnectionConfig, error) {
-	command := buildCommand(machineDir, []string{"config", machineName})
-	output, err := command.Output()
-	if err != nil {
-		return nil, err
-	}
-	args := string(bytes.TrimSpace(output))
-
-	connConfig, err := parseConnectionArgs(args)
-	if err != nil {
-		return nil, err
-	}
-
-	return connConfig, nil
-}
-
 func parseConnectionArgs(args string) (*tlsConnectionConfig, error) {
 	// Extract the -H (host) parameter
 	endpointMatches := endpointRegEx.FindAllString(args, -1)
@@ -710,9 +846,9 @@ func collectImageNames(accountID string, apiClient *v3.RancherClient) ([]string,
 		if service.LaunchConfig == nil {
 			continue
 		}
-		images = append(images, strings.TrimPrefix(service.LaunchConfig.ImageUuid, "docker:"))
+		images = append(images, rewriteImage(strings.TrimPrefix(service.LaunchConfig.ImageUuid, "docker:")))
 		for _, service := range service.SecondaryLaunchConfigs {
-			images = append(images, strings.TrimPrefix(service.ImageUuid, "docker:"))
+			images = append(images, rewriteImage(strings.TrimPrefix(service.ImageUuid, "docker:")))
 		}
 	}
 
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
 )
 
 type MockMachineOperations struct {
@@ -108,6 +109,18 @@ func TestBuildMacineCreateCommandWithInterfaceLists(t *testing.T) {
 
 }
 
+func TestBuildMachineCreateCmdMissingConfig(t *testing.T) {
+	assert := require.New(t)
+
+	host := &client.Host{Driver: "rackspace", Data: map[string]interface{}{"fields": "invalid"}}
+	_, err := buildMachineCreateCmd(host, "rackspace")
+	assert.NotNil(err)
+
+	host.Data = map[string]interface{}{}
+	_, err = buildMachineCreateCmd(host, "rackspace")
+	assert.NotNil(err)
+}
+
 func TestBuildMachineEngineOptsCommand1(t *testing.T) {
 	engineOpts := map[string]interface{}{"key1": "val1", "key2": "val2"}
 
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// agentLogLines is the number of output lines kept per agent container.
+	agentLogLines = 50
+	// summaryLogLines is the number of them included in the error reply.
+	summaryLogLines = 5
+	agentContName   = "rancher-agent"
+)
+
+// unreachableRegEx matches the agent output of a registration URL it can't reach.
+var unreachableRegEx = regexp.MustCompile(`(?i)(is not accessible|failed to connect|connection refused|no such host|could not resolve|network is unreachable|i/o timeout|x509:|curl: \(\d+\))`)
+
+// agentDiagnostics collects the events and the last output lines of the agent
+// containers while the agent is started. The bootstrap container removes
+// itself once it exits, so they are followed as they run.
+type agentDiagnostics struct {
+	sync.Mutex
+	logs     map[string][]string
+	exits    map[string]int
+	replacer *strings.Replacer
+}
+
+// newAgentDiagnostics returns diagnostics redacting secret from the output,
+// such as the registration URL, which holds the registration token.
+func newAgentDiagnostics(secret string) *agentDiagnostics {
+	replacements := []string{}
+	if secret != "" {
+		replacements = append(replacements, secret, redacted)
+	}
+	return &agentDiagnostics{
+		logs:     map[string][]string{},
+		exits:    map[string]int{},
+		replacer: strings.NewReplacer(replacements...),
+	}
+}
+
+func (d *agentDiagnostics) line(container, line string) {
+	d.Lock()
+	defer d.Unlock()
+	lines := append(d.logs[container], d.replacer.Replace(line))
+	if len(lines) > agentLogLines {
+		lines = lines[len(lines)-agentLogLines:]
+	}
+	d.logs[container] = lines
+}
+
+func (d *agentDiagnostics) died(container string, exitCode int) {
+	d.Lock()
+	defer d.Unlock()
+	d.exits[container] = exitCode
+}
+
+// cause returns why the agent did not register, as far as its containers
+// tell: the registration URL unreachable from the machine, a container that
+// crashed, or "" if neither.
+func (d *agentDiagnostics) cause() string {
+	d.Lock()
+	defer d.Unlock()
+	for _, container := range []string{agentContName, bootstrapContName} {
+		for _, line := range d.logs[container] {
+			if unreachableRegEx.MatchString(line) {
+				return "the machine can't reach the registration URL"
+			}
+		}
+	}
+	for _, container := range []string{agentContName, bootstrapContName} {
+		if code, ok := d.exits[container]; ok && code != 0 {
+			return fmt.Sprintf("container %s crashed with exit code %d", container, code)
+		}
+	}
+	return ""
+}
+
+// summary returns the cause and the last lines of each container.
+func (d *agentDiagnostics) summary(lines int) string {
+	cause := d.cause()
+	d.Lock()
+	defer d.Unlock()
+
+	parts := []string{}
+	if cause != "" {
+		parts = append(parts, cause)
+	}
+	containers := []string{}
+	for container := range d.logs {
+		containers = append(containers, container)
+	}
+	sort.Strings(containers)
+	for _, container := range containers {
+		output := d.logs[container]
+		if len(output) > lines {
+			output = output[len(output)-lines:]
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", container, strings.Join(output, " | ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// writeTo writes all the lines kept to the provisioning log.
+func (d *agentDiagnostics) writeTo(t *transcript) {
+	d.Lock()
+	defer d.Unlock()
+	for container, lines := range d.logs {
+		for _, line := range lines {
+			t.Printf(container, "%s", line)
+		}
+	}
+	for container, code := range d.exits {
+		t.Printf("gms", "%s exited with code %d", container, code)
+	}
+}
+
+// wrap returns err along with the summary of the diagnostics, if any.
+func (d *agentDiagnostics) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	summary := d.summary(summaryLogLines)
+	if summary == "" {
+		return err
+	}
+	return &agentError{err: err, summary: summary}
+}
+
+// agentFailed writes the diagnostics of the failed agent start of the host to
+// its provisioning log and returns err along with their summary.
+func agentFailed(hostID string, d *agentDiagnostics, err error) error {
+	t, terr := openTranscript(hostID, nil)
+	if terr != nil {
+		logger.WithField("resourceId", hostID).Warnf("Failed to open provisioning log: %v", terr)
+	}
+	d.writeTo(t)
+	t.Close()
+	return d.wrap(err)
+}
+
+// agentError is an agent bootstrap error with the diagnosis of its containers.
+type agentError struct {
+	err     error
+	summary string
+}
+
+func (e *agentError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.err, e.summary)
+}
+
+// Cause keeps the agent error classes of errorClass.
+func (e *agentError) Cause() error {
+	return e.err
+}
+
+// scanLines calls fn with each line of r, until r ends. What can't be scanned,
+// such as a too long line, is drained so that the writer never blocks.
+func scanLines(r io.Reader, fn func(string)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			fn(line)
+		}
+	}
+	io.Copy(ioutil.Discard, r)
+}
+
+// demuxReader reads the log stream of a container without a tty, stripping
+// the header docker prefixes each chunk of stdout or stderr with.
+type demuxReader struct {
+	r         io.Reader
+	remaining int
+}
+
+func (d *demuxReader) Read(p []byte) (int, error) {
+	for d.remaining == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			return 0, err
+		}
+		d.remaining = int(binary.BigEndian.Uint32(header[4:]))
+	}
+	if len(p) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= n
+	return n, err
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentDiagnostics(t *testing.T) {
+	assert := require.New(t)
+
+	registrationURL := "http://cattle:8080/v3/scripts/secret-token"
+	d := newAgentDiagnostics(registrationURL)
+	d.line(bootstrapContName, "Starting agent for "+registrationURL)
+	assert.Equal("", d.cause())
+
+	d.died(agentContName, 1)
+	assert.Equal("container rancher-agent crashed with exit code 1", d.cause())
+
+	d.line(agentContName, "ERROR: http://cattle:8080/v3 is not accessible (Could not resolve host: cattle)")
+	assert.Equal("the machine can't reach the registration URL", d.cause())
+
+	err := d.wrap(errAgentNotRegistered)
+	assert.Equal(errAgentNotRegistered, errors.Cause(err))
+	assert.Equal(errorClassAgentTimeout, errorClass(err))
+	assert.Contains(err.Error(), "Starting agent for "+redacted)
+	assert.NotContains(err.Error(), "secret-token")
+
+	for i := 0; i < agentLogLines+10; i++ {
+		d.line(agentContName, "line")
+	}
+	assert.Len(d.logs[agentContName], agentLogLines)
+	assert.Equal(errAgentNotRegistered, newAgentDiagnostics("").wrap(errAgentNotRegistered))
+}
+
+func TestDemuxReader(t *testing.T) {
+	assert := require.New(t)
+
+	stream := &bytes.Buffer{}
+	for _, chunk := range []struct {
+		stream byte
+		data   string
+	}{{1, "stdout line\n"}, {2, "stderr "}, {2, "line\n"}} {
+		stream.Write([]byte{chunk.stream, 0, 0, 0, 0, 0, 0, byte(len(chunk.data))})
+		stream.WriteString(chunk.data)
+	}
+
+	content, err := ioutil.ReadAll(&demuxReader{r: stream})
+	assert.Nil(err)
+	assert.Equal("stdout line\nstderr line\n", string(content))
+}
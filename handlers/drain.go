@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/event-subscriber/events"
+	client "github.com/rancher/go-rancher/v3"
+)
+
+var inflight = &handlerTracker{}
+
+type handlerTracker struct {
+	sync.Mutex
+	count     int
+	running   map[string]int
+	resources map[string]int
+	waiters   []chan struct{}
+}
+
+func (t *handlerTracker) add(name, resourceID string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.running == nil {
+		t.running = map[string]int{}
+		t.resources = map[string]int{}
+	}
+	t.count++
+	t.running[name]++
+	t.resources[resourceID]++
+}
+
+func (t *handlerTracker) done(name, resourceID string) {
+	t.Lock()
+	defer t.Unlock()
+	t.count--
+	t.running[name]--
+	if t.running[name] == 0 {
+		delete(t.running, name)
+	}
+	t.resources[resourceID]--
+	if t.resources[resourceID] == 0 {
+		delete(t.resources, resourceID)
+	}
+	if t.count > 0 {
+		return
+	}
+	for _, w := range t.waiters {
+		close(w)
+	}
+	t.waiters = nil
+}
+
+func (t *handlerTracker) idle() <-chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+	c := make(chan struct{})
+	if t.count == 0 {
+		close(c)
+	} else {
+		t.waiters = append(t.waiters, c)
+	}
+	return c
+}
+
+// Track wraps the handler registered for the named event so that its executions
+// are accounted for by Drain and Running.
+func Track(name string, handler events.EventHandler) events.EventHandler {
+	return func(event *events.Event, apiClient *client.RancherClient) error {
+		inflight.add(name, event.ResourceID)
+		defer inflight.done(name, event.ResourceID)
+		return handler(event, apiClient)
+	}
+}
+
+// Running returns the number of tracked handlers currently running per event name.
+func Running() map[string]int {
+	inflight.Lock()
+	defer inflight.Unlock()
+	running := map[string]int{}
+	for name, count := range inflight.running {
+		running[name] = count
+	}
+	return running
+}
+
+// Handling returns whether a tracked handler is running for the resource.
+func Handling(resourceID string) bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	return inflight.resources[resourceID] > 0
+}
+
+// Drain waits up to timeout for all tracked handlers to return. It returns false
+// if handlers were still running when the timeout expired.
+func Drain(timeout time.Duration) bool {
+	select {
+	case <-inflight.idle():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
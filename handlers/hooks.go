@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"golang.org/x/net/context"
+)
+
+const (
+	// hookLabelPrefix labels hold a post-create script, such as
+	// io.rancher.host.hook.mount-volumes=<script>.
+	hookLabelPrefix = "io.rancher.host.hook."
+	// hooksField is the host template value, public or secret, mapping hook
+	// names to their script. Labels override template hooks of the same name.
+	hooksField = "postCreateHooks"
+	hooksFile  = "hooks.json"
+)
+
+// hook is a script run as root on a new machine before the agent starts.
+type hook struct {
+	name   string
+	script string
+}
+
+func (h hook) checksum() string {
+	sum := sha256.Sum256([]byte(h.script))
+	return hex.EncodeToString(sum[:])
+}
+
+// remoteCommand returns the shell command running the script as root. The
+// script is passed encoded so that it needs no quoting and works with both the
+// external and the native ssh client of docker-machine. Scripts starting with
+// #! run with their own interpreter, others with sh.
+func (h hook) remoteCommand() string {
+	encoded := b64.StdEncoding.EncodeToString([]byte(h.script))
+	if !strings.HasPrefix(h.script, "#!") {
+		return fmt.Sprintf("echo %s | base64 -d | sudo sh", encoded)
+	}
+	return fmt.Sprintf("f=$(mktemp) && echo %s | base64 -d > $f && chmod 700 $f && sudo $f; rc=$?; rm -f $f; exit $rc", encoded)
+}
+
+// hookResult records a hook run in the machine dir, which is uploaded with the
+// machine config, so that hooks already run on a restored machine are skipped.
+type hookResult struct {
+	Name     string    `json:"name"`
+	Checksum string    `json:"checksum"`
+	ExitCode int       `json:"exitCode"`
+	Finished time.Time `json:"finished"`
+}
+
+// postCreateHooks returns the hooks of the host, its template already applied.
+// The user data of drivers not taking it at create time runs first, then the
+// other hooks sorted by name.
+func postCreateHooks(host *v3.Host) []hook {
+	scripts := map[string]string{}
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	if templateHooks, ok := fields[hooksField].(map[string]interface{}); ok {
+		for name, script := range templateHooks {
+			if s, ok := script.(string); ok {
+				scripts[name] = s
+			}
+		}
+	}
+	for label, value := range host.Labels {
+		if s, ok := value.(string); ok && strings.HasPrefix(label, hookLabelPrefix) {
+			scripts[strings.TrimPrefix(label, hookLabelPrefix)] = s
+		}
+	}
+
+	hooks := []hook{}
+	for name, script := range scripts {
+		if name != "" && strings.TrimSpace(script) != "" {
+			hooks = append(hooks, hook{name: name, script: script})
+		}
+	}
+	sort.Sort(hooksByName(hooks))
+	return append(userDataHooks(host), hooks...)
+}
+
+type hooksByName []hook
+
+func (h hooksByName) Len() int           { return len(h) }
+func (h hooksByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hooksByName) Less(i, j int) bool { return h[i].name < h[j].name }
+
+func hookResultsFile(hostDir string, host *v3.Host) string {
+	return filepath.Join(hostDir, "machines", host.Hostname, hooksFile)
+}
+
+func readHookResults(hostDir string, host *v3.Host) ([]hookResult, error) {
+	results := []hookResult{}
+	content, err := ioutil.ReadFile(hookResultsFile(hostDir, host))
+	if os.IsNotExist(err) {
+		return results, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return results, errors.Wrap(json.Unmarshal(content, &results), "Reading hook results")
+}
+
+func writeHookResults(hostDir string, host *v3.Host, results []hookResult) error {
+	content, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(hookResultsFile(hostDir, host), content, 0600)
+}
+
+func hookSucceeded(results []hookResult, h hook) bool {
+	for _, result := range results {
+		if result.Name == h.name && result.Checksum == h.checksum() && result.ExitCode == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runPostCreateHooks runs the hooks of the host that have not succeeded on
+// the machine yet, in name order, over docker-machine ssh. A failing hook
+// fails the provisioning. Once hooks ran, or one failed, the machine config is
+// uploaded again so that their results are restored along with the machine
+// and a retry skips the hooks that already succeeded.
+func runPostCreateHooks(event *events.Event, apiClient *v3.RancherClient, publishChan chan progress, log *logrus.Entry, op *operation) error {
+	host, hostDir, err := getHostAndHostDir(event, apiClient)
+	if err != nil || host == nil {
+		return err
+	}
+	if err := applyHostTemplate(host, apiClient); err != nil {
+		return err
+	}
+
+	results, err := readHookResults(hostDir, host)
+	if err != nil {
+		return err
+	}
+	pending := []hook{}
+	for _, h := range postCreateHooks(host) {
+		if !hookSucceeded(results, h) {
+			pending = append(pending, h)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	t, err := openTranscript(host.Id, nil)
+	if err != nil {
+		log.Warnf("Failed to open provisioning log: %v", err)
+	}
+	defer t.Close()
+
+	step := eventSpan(event).Child("postCreateHooks")
+	defer func() {
+		step.Finish(err)
+	}()
+
+	for _, h := range pending {
+		publishChan <- progress{phaseRunningHooks, fmt.Sprintf("Running hook %s", h.name)}
+		exitCode := 0
+		err = provisionPolicy(host, config.PhasePostCreateHooks, log).run(op.ctx, func(ctx context.Context) error {
+			var runErr error
+			exitCode, runErr = runHook(ctx, h, host, hostDir, correlationID(event), publishChan, log, op, t)
+			return runErr
+		})
+		results = append(results, hookResult{
+			Name:     h.name,
+			Checksum: h.checksum(),
+			ExitCode: exitCode,
+			Finished: time.Now(),
+		})
+		if err := writeHookResults(hostDir, host, results); err != nil {
+			return err
+		}
+		if err != nil {
+			log.Errorf("Hook %s failed: %v", h.name, err)
+			if saveErr := saveExtractedConfig(op.ctx, hostDir, host, apiClient, log); saveErr != nil {
+				log.Warnf("Failed to save machine config with the hook results: %v", saveErr)
+			}
+			return errors.Wrapf(err, "Hook %s failed", h.name)
+		}
+	}
+
+	return saveExtractedConfig(op.ctx, hostDir, host, apiClient, log)
+}
+
+// runHook runs the hook once, killing it when ctx is done, and returns its exit code.
+func runHook(ctx context.Context, h hook, host *v3.Host, hostDir, correlationID string, publishChan chan<- progress,
+	log *logrus.Entry, op *operation, t *transcript) (int, error) {
+	command := buildCommand(hostDir, []string{"ssh", host.Hostname, h.remoteCommand()})
+	setCorrelationID(command, correlationID)
+
+	stdout, stderr, err := startReturnOutput(command)
+	if err != nil {
+		return -1, err
+	}
+	op.setCommand(command)
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCommand(command)
+		case <-exited:
+		}
+	}()
+
+	t.Printf("gms", "Running hook %s", h.name)
+	var wg sync.WaitGroup
+	for stream, r := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+		wg.Add(1)
+		go func(stream string, r io.Reader) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				line := scanner.Text()
+				log.Infof("hook %s %s: %s", h.name, stream, line)
+				t.Printf(stream, "[%s] %s", h.name, line)
+				publishChan <- progress{message: fmt.Sprintf("[%s] %s", h.name, line)}
+			}
+		}(stream, r)
+	}
+	wg.Wait()
+
+	err = command.Wait()
+	close(exited)
+	op.setCommand(nil)
+	t.Printf("gms", "Hook %s exited: %v", h.name, command.ProcessState)
+	if command.ProcessState != nil {
+		if status, ok := command.ProcessState.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), err
+		}
+	}
+	return -1, err
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostCreateHooks(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{
+		Labels: map[string]interface{}{
+			hookLabelPrefix + "ca":      "update-ca-certificates",
+			hookLabelPrefix + "sysctl":  "sysctl -w vm.max_map_count=262144",
+			"io.rancher.host.os":        "linux",
+			hookLabelPrefix + "disable": " ",
+		},
+	}
+	host.Data = map[string]interface{}{
+		"fields": map[string]interface{}{
+			hooksField: map[string]interface{}{
+				"ca":    "cp /tmp/ca.pem /usr/local/share/ca-certificates/",
+				"mount": "mount /dev/xvdb /data",
+			},
+		},
+	}
+
+	hooks := postCreateHooks(host)
+	assert.Equal([]hook{
+		{name: "ca", script: "update-ca-certificates"},
+		{name: "mount", script: "mount /dev/xvdb /data"},
+		{name: "sysctl", script: "sysctl -w vm.max_map_count=262144"},
+	}, hooks)
+}
+
+func TestHookResults(t *testing.T) {
+	assert := require.New(t)
+
+	hostDir, err := ioutil.TempDir("", "gms-hooks")
+	assert.Nil(err)
+	defer os.RemoveAll(hostDir)
+	host := &v3.Host{Hostname: "host1"}
+	assert.Nil(os.MkdirAll(filepath.Join(hostDir, "machines", "host1"), 0700))
+
+	results, err := readHookResults(hostDir, host)
+	assert.Nil(err)
+	assert.Empty(results)
+
+	mount := hook{name: "mount", script: "mount /dev/xvdb /data"}
+	sysctl := hook{name: "sysctl", script: "sysctl -w vm.max_map_count=262144"}
+	assert.Nil(writeHookResults(hostDir, host, []hookResult{
+		{Name: "mount", Checksum: mount.checksum()},
+		{Name: "sysctl", Checksum: sysctl.checksum(), ExitCode: 1},
+	}))
+
+	results, err = readHookResults(hostDir, host)
+	assert.Nil(err)
+	assert.True(hookSucceeded(results, mount))
+	assert.False(hookSucceeded(results, sysctl))
+
+	// A changed script runs again
+	mount.script = "mount /dev/xvdc /data"
+	assert.False(hookSucceeded(results, mount))
+}
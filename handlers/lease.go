@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const leaseDataKey = "machineServiceLease"
+
+var errLeaseHeld = errors.New("Host is leased by another machine service instance")
+
+// leaseSettle is how long an instance waits after writing its lease before
+// reading it back. Cattle has no compare-and-swap on host data, so instances
+// that found the host free at the same time both write their lease, and the
+// one whose lease was overwritten backs off once it reads the host again.
+const leaseSettle = 2 * time.Second
+
+type lease struct {
+	Owner string `json:"owner"`
+	// Nonce tells apart the acquisitions of the same owner, such as those of
+	// an instance restarted with the same identity.
+	Nonce   string    `json:"nonce,omitempty"`
+	Expires time.Time `json:"expires"`
+	// Purged is set when the holder purged the machine, so that other instances
+	// don't try to remove it again.
+	Purged bool `json:"purged,omitempty"`
+}
+
+func (l *lease) heldByOther(owner string, now time.Time) bool {
+	return l != nil && l.Owner != "" && l.Owner != owner && now.Before(l.Expires)
+}
+
+// ownedBy returns whether the lease is the one written by owner with nonce.
+func (l *lease) ownedBy(owner, nonce string) bool {
+	return l != nil && l.Owner == owner && l.Nonce == nonce
+}
+
+func getLease(host *v3.Host) *lease {
+	return decodeLease(host.Data[leaseDataKey])
+}
+
+func decodeLease(value interface{}) *lease {
+	if value == nil {
+		return nil
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	l := &lease{}
+	if err := json.Unmarshal(content, l); err != nil {
+		return nil
+	}
+	return l
+}
+
+var hostDataLocks = struct {
+	sync.Mutex
+	locks map[string]*hostDataLock
+}{locks: map[string]*hostDataLock{}}
+
+type hostDataLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockHostData serializes the updates of the data of the host by this
+// instance, and returns the unlock.
+func lockHostData(hostID string) func() {
+	hostDataLocks.Lock()
+	l, ok := hostDataLocks.locks[hostID]
+	if !ok {
+		l = &hostDataLock{}
+		hostDataLocks.locks[hostID] = l
+	}
+	l.refs++
+	hostDataLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		hostDataLocks.Lock()
+		defer hostDataLocks.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(hostDataLocks.locks, hostID)
+		}
+	}
+}
+
+// updateHostData reads the key of the data of the host, lets update return
+// its new value, and writes back that key only, so that the other keys of the
+// data, written by Cattle or other instances since the host was read, are not
+// reverted. The updates of this instance are serialized, so that the value
+// update is given is the current one. If update returns an error, nothing is
+// written.
+func updateHostData(hostID, key string, apiClient *v3.RancherClient, update func(current interface{}) (interface{}, error)) (*v3.Host, error) {
+	defer lockHostData(hostID)()
+
+	host, err := apiClient.Host.ById(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if host == nil {
+		return nil, errors.Errorf("can't find host with resourceId %v", hostID)
+	}
+
+	value, err := update(host.Data[key])
+	if err != nil {
+		return nil, err
+	}
+
+	return apiClient.Host.Update(host, map[string]interface{}{
+		"data": map[string]interface{}{key: value},
+	})
+}
+
+// writeHostData sets the key of the data of the host to value.
+func writeHostData(hostID, key string, value interface{}, apiClient *v3.RancherClient) (*v3.Host, error) {
+	return updateHostData(hostID, key, apiClient, func(interface{}) (interface{}, error) {
+		return value, nil
+	})
+}
+
+// writeLease writes the lease unless the host holds one of another owner or
+// acquisition that is not expired, in which case it returns errLeaseHeld.
+// nonce is the acquisition of this instance the current lease must be of, or
+// "" to write a lease of a new acquisition.
+func writeLease(hostID, nonce string, l *lease, apiClient *v3.RancherClient) (*v3.Host, error) {
+	return updateHostData(hostID, leaseDataKey, apiClient, func(value interface{}) (interface{}, error) {
+		current := decodeLease(value)
+		if nonce == "" {
+			if current.heldByOther(l.Owner, time.Now()) {
+				return nil, errLeaseHeld
+			}
+		} else if current != nil && current.Owner != "" && !current.ownedBy(l.Owner, nonce) {
+			return nil, errLeaseHeld
+		}
+		return l, nil
+	})
+}
+
+func newLeaseNonce() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hostLease is a lease held by this instance. It is renewed in the background
+// until released.
+type hostLease struct {
+	hostID    string
+	nonce     string
+	config    config.Leases
+	apiClient *v3.RancherClient
+	onLost    func()
+	lost      int32
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// acquireLease claims the host for this instance, or returns errLeaseHeld if
+// another instance holds an unexpired lease. When several instances of the
+// service run at once, only the holder of the lease provisions or purges the
+// host. onLost, if set, is called if the lease is lost to another instance
+// while it is held, such as to cancel the provisioning. Leases are disabled
+// unless configured, in which case the returned lease does nothing.
+func acquireLease(host *v3.Host, apiClient *v3.RancherClient, onLost func()) (*hostLease, error) {
+	leases := conf.Leases
+	if !leases.Enabled {
+		return &hostLease{}, nil
+	}
+
+	if getLease(host).heldByOther(leases.InstanceID, time.Now()) {
+		return nil, errLeaseHeld
+	}
+
+	nonce, err := newLeaseNonce()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writeLease(host.Id, "", &lease{
+		Owner:   leases.InstanceID,
+		Nonce:   nonce,
+		Expires: time.Now().Add(leases.Duration.Duration),
+	}, apiClient); err == errLeaseHeld {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Writing host lease")
+	}
+
+	// Another instance may have found the host free and written its lease at
+	// the same time, the one whose lease is still there once both writes are
+	// through holds it
+	time.Sleep(leaseSettle)
+	current, err := apiClient.Host.ById(host.Id)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || !getLease(current).ownedBy(leases.InstanceID, nonce) {
+		return nil, errLeaseHeld
+	}
+
+	hl := &hostLease{
+		hostID:    host.Id,
+		nonce:     nonce,
+		config:    leases,
+		apiClient: apiClient,
+		onLost:    onLost,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go hl.renew()
+	return hl, nil
+}
+
+// isLost returns whether the lease was lost to another instance while held.
+func (hl *hostLease) isLost() bool {
+	return atomic.LoadInt32(&hl.lost) == 1
+}
+
+func (hl *hostLease) renew() {
+	defer close(hl.stopped)
+
+	ticker := time.NewTicker(hl.config.Duration.Duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hl.stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := writeLease(hl.hostID, hl.nonce, &lease{
+			Owner:   hl.config.InstanceID,
+			Nonce:   hl.nonce,
+			Expires: time.Now().Add(hl.config.Duration.Duration),
+		}, hl.apiClient)
+		if err == errLeaseHeld {
+			logger.WithFields(logrus.Fields{
+				"resourceId": hl.hostID,
+			}).Error("Lost host lease to another instance")
+			atomic.StoreInt32(&hl.lost, 1)
+			if hl.onLost != nil {
+				hl.onLost()
+			}
+			return
+		} else if err != nil {
+			logger.WithField("resourceId", hl.hostID).Warnf("Failed to renew host lease: %v", err)
+		}
+	}
+}
+
+// release stops renewing the lease and clears it, recording whether the
+// machine was purged. A lease lost to another instance is left to it.
+func (hl *hostLease) release(purged bool) {
+	if hl.stop == nil {
+		return
+	}
+	close(hl.stop)
+	<-hl.stopped
+	if hl.isLost() {
+		return
+	}
+
+	l := &lease{Purged: purged}
+	if _, err := writeLease(hl.hostID, hl.nonce, l, hl.apiClient); err == errLeaseHeld {
+		logger.WithField("resourceId", hl.hostID).Warn("Host lease was taken by another instance, not releasing it")
+	} else if err != nil {
+		logger.WithField("resourceId", hl.hostID).Warnf("Failed to release host lease: %v", err)
+	}
+}
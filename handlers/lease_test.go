@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLease(t *testing.T) {
+	assert := require.New(t)
+
+	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	host := &v3.Host{
+		Data: map[string]interface{}{
+			leaseDataKey: map[string]interface{}{
+				"owner":   "gms-1",
+				"expires": expires.Format(time.RFC3339),
+			},
+		},
+	}
+
+	l := getLease(host)
+	assert.NotNil(l)
+	assert.Equal("gms-1", l.Owner)
+	assert.True(expires.Equal(l.Expires))
+	assert.Nil(getLease(&v3.Host{}))
+}
+
+func TestLeaseHeldByOther(t *testing.T) {
+	assert := require.New(t)
+	now := time.Now()
+
+	l := &lease{Owner: "gms-1", Expires: now.Add(time.Minute)}
+	assert.True(l.heldByOther("gms-2", now))
+	assert.False(l.heldByOther("gms-1", now))
+	assert.False(l.heldByOther("gms-2", now.Add(2*time.Minute)))
+
+	var none *lease
+	assert.False(none.heldByOther("gms-2", now))
+	assert.False((&lease{Purged: true}).heldByOther("gms-2", now))
+}
+
+func TestLeaseOwnedBy(t *testing.T) {
+	assert := require.New(t)
+
+	l := &lease{Owner: "gms-1", Nonce: "a1", Expires: time.Now().Add(time.Minute)}
+	assert.True(l.ownedBy("gms-1", "a1"))
+	// An acquisition of the same owner that lost the race does not own it
+	assert.False(l.ownedBy("gms-1", "b2"))
+	assert.False(l.ownedBy("gms-2", "a1"))
+
+	var none *lease
+	assert.False(none.ownedBy("gms-1", "a1"))
+}
+
+func TestLockHostData(t *testing.T) {
+	assert := require.New(t)
+
+	unlock := lockHostData("1h1")
+	locked := make(chan struct{})
+	go func() {
+		lockHostData("1h1")()
+		close(locked)
+	}()
+	// Other hosts are not blocked
+	lockHostData("1h2")()
+
+	select {
+	case <-locked:
+		t.Fatal("Host data locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	hostDataLocks.Lock()
+	defer hostDataLocks.Unlock()
+	assert.Empty(hostDataLocks.locks)
+}
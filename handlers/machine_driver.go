@@ -18,30 +18,28 @@ func RemoveDriver(event *events.Event, apiClient *client.RancherClient) error {
 }
 
 func removeDriver(event *events.Event, apiClient *client.RancherClient, delete bool) error {
-	logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-		"name":       event.Name,
-	}).Info("Event")
+	log := eventLogger(event).WithField("name", event.Name)
+	log.Info("Event")
 
 	driverInfo, err := apiClient.MachineDriver.ById(event.ResourceID)
 	if err != nil {
 		return err
 	}
 
-	if err := dynamic.RemoveSchemas(driverInfo.Name+"Config", apiClient); err != nil {
+	if err := dynamic.RemoveSchemas(driverInfo.Name+"Config", apiClient, log); err != nil {
 		return err
 	}
 
 	if driverInfo.Checksum == "" || delete {
 		driver, err := getDriver(event.ResourceID, apiClient)
 		if err == nil {
-			logger.Infof("Removing driver %s", driverInfo.Name)
+			log.Infof("Removing driver %s", driverInfo.Name)
+			driver.WithLogger(log)
 			driver.Remove()
 		}
 	}
 
-	if err := dynamic.UploadMachineSchemas(apiClient); err != nil {
+	if err := dynamic.UploadMachineSchemas(apiClient, log); err != nil {
 		return err
 	}
 
@@ -50,11 +48,7 @@ func removeDriver(event *events.Event, apiClient *client.RancherClient, delete b
 }
 
 func ErrorDriver(event *events.Event, apiClient *client.RancherClient) error {
-	logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-		"name":       event.Name,
-	}).Info("Event")
+	eventLogger(event).WithField("name", event.Name).Info("Event")
 
 	driver, err := getDriver(event.ResourceID, apiClient)
 	if err != nil {
@@ -69,13 +63,10 @@ func ErrorDriver(event *events.Event, apiClient *client.RancherClient) error {
 }
 
 func ActivateDriver(event *events.Event, apiClient *client.RancherClient) error {
-	logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-		"name":       event.Name,
-	}).Info("Event")
+	log := eventLogger(event).WithField("name", event.Name)
+	log.Info("Event")
 
-	driver, err := activate(event.ResourceID, apiClient)
+	driver, err := activate(event.ResourceID, apiClient, log)
 	if err != nil {
 		return err
 	}
@@ -92,7 +83,7 @@ func ActivateDriver(event *events.Event, apiClient *client.RancherClient) error
 		"schemaVersion": version,
 	}
 
-	if err := dynamic.UploadMachineSchemas(apiClient, driver.FriendlyName()); err != nil {
+	if err := dynamic.UploadMachineSchemas(apiClient, log, driver.FriendlyName()); err != nil {
 		return err
 	}
 
@@ -108,11 +99,12 @@ func getDriver(id string, apiClient *client.RancherClient) (*dynamic.Driver, err
 	return dynamic.NewDriver(driverInfo.Builtin, driverInfo.Name, driverInfo.Url, driverInfo.Checksum), nil
 }
 
-func activate(id string, apiClient *client.RancherClient) (*dynamic.Driver, error) {
+func activate(id string, apiClient *client.RancherClient, log *logrus.Entry) (*dynamic.Driver, error) {
 	driver, err := getDriver(id, apiClient)
 	if err != nil {
 		return nil, err
 	}
+	driver.WithLogger(log)
 
 	if err := driver.Stage(); err != nil {
 		return nil, err
@@ -131,9 +123,9 @@ func activate(id string, apiClient *client.RancherClient) (*dynamic.Driver, erro
 	}
 
 	if err := driver.Install(); err != nil {
-		logger.Errorf("Failed to download/install driver %s: %v", driver.Name(), err)
+		log.Errorf("Failed to download/install driver %s: %v", driver.Name(), err)
 		return nil, err
 	}
 
-	return driver, dynamic.GenerateAndUploadSchema(driver.Name())
+	return driver, dynamic.GenerateAndUploadSchema(driver.Name(), log)
 }
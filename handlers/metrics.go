@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	"github.com/rancher/go-machine-service/handlers/providers"
+	"github.com/rancher/go-machine-service/metrics"
+)
+
+const (
+	phaseContactingDriver = "contacting_driver"
+	phaseInstallingAgent  = "installing_agent"
+	phaseWaitingForAgent  = "waiting_for_agent"
+
+	resultSuccess = "success"
+	resultError   = "error"
+
+	errorClassAgentTimeout = "agent_timeout"
+	errorClassInternal     = "internal"
+	errorClassCanceled     = "canceled"
+	errorClassTimeout      = "timeout"
+)
+
+var (
+	phaseBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200}
+
+	provisionPhaseDuration = metrics.NewHistogram("gms_provision_phase_duration_seconds",
+		"Duration of each host provisioning phase.", phaseBuckets, "driver", "phase")
+	provisionTotal = metrics.NewCounter("gms_provision_total",
+		"Host provisions by driver, result and error class.", "driver", "result", "error_class")
+	purgeTotal = metrics.NewCounter("gms_purge_total",
+		"Host purges by driver, result and error class.", "driver", "result", "error_class")
+)
+
+var (
+	errAgentContainerNotFound = errors.New("Failed to find rancher-agent container")
+	errAgentNotRegistered     = errors.New("Host is not registered correctly")
+)
+
+// driverError is an error reported by docker-machine, already prettified by Provider.HandleError.
+type driverError struct {
+	msg string
+}
+
+func (e *driverError) Error() string {
+	return e.msg
+}
+
+func errorClass(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case *driverError:
+		return providers.ErrorClass(cause.msg)
+	case *phaseTimeoutError:
+		switch cause.phase {
+		case config.PhaseAgentContainer, config.PhaseAgentRegistration:
+			return errorClassAgentTimeout
+		}
+		return errorClassTimeout
+	}
+	switch errors.Cause(err) {
+	case errAgentContainerNotFound, errAgentNotRegistered:
+		return errorClassAgentTimeout
+	case errProvisionCanceled:
+		return errorClassCanceled
+	}
+	return errorClassInternal
+}
+
+func recordOutcome(counter *metrics.Counter, driver string, err error) {
+	if err == nil {
+		counter.Inc(driver, resultSuccess, "")
+		return
+	}
+	counter.Inc(driver, resultError, errorClass(err))
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_errorClass(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("authentication", errorClass(&driverError{msg: "Invalid username or apiKey"}))
+	assert.Equal(errorClassAgentTimeout, errorClass(errAgentNotRegistered))
+	assert.Equal(errorClassAgentTimeout, errorClass(errors.Wrap(errAgentContainerNotFound, "bootstrap")))
+	assert.Equal(errorClassInternal, errorClass(errors.New("failed to create bootstrap container")))
+}
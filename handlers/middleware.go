@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/logging"
+	"github.com/rancher/go-machine-service/metrics"
+	"github.com/rancher/go-machine-service/tracing"
+	client "github.com/rancher/go-rancher/v3"
+)
+
+const correlationIDEnv = "GMS_CORRELATION_ID"
+
+var eventDuration = metrics.NewHistogram("gms_event_duration_seconds",
+	"Duration of event handling.", []float64{0.1, 0.5, 1, 5, 15, 60, 300, 600, 1200}, "event", "result")
+
+// Middleware wraps the handler registered for the named event.
+type Middleware func(name string, handler events.EventHandler) events.EventHandler
+
+// Wrap applies the middlewares to every handler of the map. The first
+// middleware is the outermost one.
+func Wrap(eventHandlers map[string]events.EventHandler, middlewares ...Middleware) map[string]events.EventHandler {
+	wrapped := map[string]events.EventHandler{}
+	for name, handler := range eventHandlers {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](name, handler)
+		}
+		wrapped[name] = handler
+	}
+	return wrapped
+}
+
+// Correlate attaches a correlation ID to the event, which eventLogger adds to
+// every log entry and which is passed to docker-machine in its environment.
+func Correlate(name string, handler events.EventHandler) events.EventHandler {
+	return func(event *events.Event, apiClient *client.RancherClient) error {
+		if correlationID(event) == "" {
+			if event.Data == nil {
+				event.Data = map[string]interface{}{}
+			}
+			event.Data[logging.CorrelationIDField] = logging.NewCorrelationID()
+		}
+		return handler(event, apiClient)
+	}
+}
+
+var eventSpans = struct {
+	sync.Mutex
+	spans map[*events.Event]*tracing.Span
+}{spans: map[*events.Event]*tracing.Span{}}
+
+// Trace records a span for the handling of the event, to which the handlers add
+// the spans of their steps.
+func Trace(name string, handler events.EventHandler) events.EventHandler {
+	if name == "ping" {
+		return handler
+	}
+	return func(event *events.Event, apiClient *client.RancherClient) (err error) {
+		span := tracing.Start(name)
+		span.SetAttribute("eventId", event.ID)
+		span.SetAttribute("resourceId", event.ResourceID)
+		span.SetAttribute(logging.CorrelationIDField, correlationID(event))
+		defer func() {
+			span.Finish(err)
+		}()
+
+		eventSpans.Lock()
+		eventSpans.spans[event] = span
+		eventSpans.Unlock()
+		defer func() {
+			eventSpans.Lock()
+			delete(eventSpans.spans, event)
+			eventSpans.Unlock()
+		}()
+
+		return handler(event, apiClient)
+	}
+}
+
+// eventSpan returns the span of the event, or nil if it isn't traced.
+func eventSpan(event *events.Event) *tracing.Span {
+	eventSpans.Lock()
+	defer eventSpans.Unlock()
+	return eventSpans.spans[event]
+}
+
+// Time logs and records how long each event took to handle.
+func Time(name string, handler events.EventHandler) events.EventHandler {
+	return func(event *events.Event, apiClient *client.RancherClient) error {
+		start := time.Now()
+		err := handler(event, apiClient)
+
+		result := resultSuccess
+		if err != nil {
+			result = resultError
+		}
+		eventDuration.Since(start, name, result)
+		if name != "ping" {
+			eventLogger(event).WithFields(logrus.Fields{
+				"duration": time.Since(start).String(),
+				"result":   result,
+			}).Debug("Event handled")
+		}
+		return err
+	}
+}
+
+// Recover converts a panic in the handler into an error, so that an error reply
+// is published for the event instead of the process exiting.
+func Recover(name string, handler events.EventHandler) events.EventHandler {
+	return func(event *events.Event, apiClient *client.RancherClient) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				eventLogger(event).Errorf("Panic handling %s: %v\n%s", name, r, debug.Stack())
+				err = errors.Errorf("Internal error handling %s: %v", name, r)
+			}
+		}()
+		return handler(event, apiClient)
+	}
+}
+
+func correlationID(event *events.Event) string {
+	id, _ := event.Data[logging.CorrelationIDField].(string)
+	return id
+}
+
+// eventLogger returns a logger carrying the IDs of the event.
+func eventLogger(event *events.Event) *logrus.Entry {
+	fields := logrus.Fields{
+		"resourceId":               event.ResourceID,
+		"eventId":                  event.ID,
+		logging.CorrelationIDField: correlationID(event),
+	}
+	if span := eventSpan(event); span != nil {
+		fields["traceId"] = span.TraceID
+	}
+	return logger.WithFields(fields)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/rancher/event-subscriber/events"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapOrder(t *testing.T) {
+	assert := require.New(t)
+
+	calls := []string{}
+	middleware := func(tag string) Middleware {
+		return func(name string, handler events.EventHandler) events.EventHandler {
+			return func(event *events.Event, apiClient *v3.RancherClient) error {
+				calls = append(calls, tag+":"+name)
+				return handler(event, apiClient)
+			}
+		}
+	}
+
+	wrapped := Wrap(map[string]events.EventHandler{
+		"host.provision": func(event *events.Event, apiClient *v3.RancherClient) error {
+			calls = append(calls, "handler")
+			return nil
+		},
+	}, middleware("outer"), middleware("inner"))
+
+	assert.Nil(wrapped["host.provision"](&events.Event{}, nil))
+	assert.Equal([]string{"outer:host.provision", "inner:host.provision", "handler"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	assert := require.New(t)
+
+	handler := Recover("host.provision", func(event *events.Event, apiClient *v3.RancherClient) error {
+		var fields map[string]interface{}
+		fields["panics"] = true
+		return nil
+	})
+
+	err := handler(&events.Event{ID: "1", ResourceID: "1h1"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "host.provision")
+}
+
+func TestCorrelate(t *testing.T) {
+	assert := require.New(t)
+
+	var seen string
+	handler := Correlate("host.provision", func(event *events.Event, apiClient *v3.RancherClient) error {
+		seen = correlationID(event)
+		return nil
+	})
+
+	assert.Nil(handler(&events.Event{}, nil))
+	assert.NotEmpty(seen)
+
+	event := &events.Event{Data: map[string]interface{}{"correlationId": "abc"}}
+	assert.Nil(handler(event, nil))
+	assert.Equal("abc", seen)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	rpcdriver "github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/pkg/errors"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+// hostConfigVersion is the version of the host config docker-machine writes,
+// the only one read by the native backend.
+const hostConfigVersion = 3
+
+var errUnsupportedHost = errors.New("Host config not supported by the native machine backend")
+
+// hostConfig is the part of the config.json docker-machine keeps for each
+// machine that the native backend needs.
+type hostConfig struct {
+	ConfigVersion int
+	Driver        json.RawMessage
+	DriverName    string
+	HostOptions   struct {
+		AuthOptions struct {
+			CaCertPath     string
+			ClientCertPath string
+			ClientKeyPath  string
+		}
+	}
+	Name string
+}
+
+// nativeBackend reads the host store of the machine dirs directly and talks to
+// the driver plugins over RPC, instead of running docker-machine and parsing
+// its output. Hosts it can't handle, such as those written by an older
+// docker-machine or whose driver plugin is missing, are left to the fallback.
+//
+// It doesn't create machines: provisioning their engine needs the libmachine
+// provisioners, which aren't vendored, so docker-machine create still does.
+//
+// Core driver plugins are run from the docker-machine found in the PATH, as
+// docker-machine itself does.
+type nativeBackend struct {
+	fallback machineBackend
+}
+
+func hostConfigFile(machineDir, name string) string {
+	return filepath.Join(machineDir, "machines", name, "config.json")
+}
+
+func readHostConfig(machineDir, name string) (*hostConfig, error) {
+	content, err := ioutil.ReadFile(hostConfigFile(machineDir, name))
+	if err != nil {
+		return nil, err
+	}
+	hc := &hostConfig{}
+	if err := json.Unmarshal(content, hc); err != nil {
+		return nil, errors.Wrapf(err, "Reading config of machine %s", name)
+	}
+	if hc.ConfigVersion != hostConfigVersion {
+		return nil, errUnsupportedHost
+	}
+	return hc, nil
+}
+
+// withDriver runs f with an RPC client of the driver plugin of the machine,
+// which is stopped once f returns.
+func withDriver(hc *hostConfig, f func(driver *rpcdriver.RPCClientDriver) error) error {
+	factory := rpcdriver.NewRPCClientDriverFactory()
+	defer factory.Close()
+
+	driver, err := factory.NewRPCClientDriver(hc.DriverName, hc.Driver)
+	if _, ok := err.(localbinary.ErrPluginBinaryNotFound); ok {
+		return errUnsupportedHost
+	} else if err != nil {
+		return errors.Wrapf(err, "Starting %s driver plugin", hc.DriverName)
+	}
+	return f(driver)
+}
+
+func (b *nativeBackend) exists(machineDir, name string) (bool, error) {
+	_, err := os.Stat(hostConfigFile(machineDir, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *nativeBackend) state(machineDir, name string) (string, error) {
+	hc, err := readHostConfig(machineDir, name)
+	if err == errUnsupportedHost {
+		return b.fallback.state(machineDir, name)
+	} else if err != nil {
+		return "", err
+	}
+
+	var state string
+	err = withDriver(hc, func(driver *rpcdriver.RPCClientDriver) error {
+		s, err := driver.GetState()
+		state = s.String()
+		return err
+	})
+	if err == errUnsupportedHost {
+		return b.fallback.state(machineDir, name)
+	}
+	return state, err
+}
+
+func (b *nativeBackend) ip(machineDir, name string) (string, error) {
+	hc, err := readHostConfig(machineDir, name)
+	if err == errUnsupportedHost {
+		return b.fallback.ip(machineDir, name)
+	} else if err != nil {
+		return "", err
+	}
+
+	var ip string
+	err = withDriver(hc, func(driver *rpcdriver.RPCClientDriver) error {
+		ip, err = driver.GetIP()
+		return err
+	})
+	if err == errUnsupportedHost {
+		return b.fallback.ip(machineDir, name)
+	}
+	return ip, err
+}
+
+func (b *nativeBackend) connectionConfig(machineDir, name string) (*tlsConnectionConfig, error) {
+	hc, err := readHostConfig(machineDir, name)
+	if err == errUnsupportedHost {
+		return b.fallback.connectionConfig(machineDir, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var endpoint string
+	err = withDriver(hc, func(driver *rpcdriver.RPCClientDriver) error {
+		endpoint, err = driver.GetURL()
+		return err
+	})
+	if err == errUnsupportedHost {
+		return b.fallback.connectionConfig(machineDir, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	auth := hc.HostOptions.AuthOptions
+	return &tlsConnectionConfig{
+		endpoint: endpoint,
+		caCert:   auth.CaCertPath,
+		cert:     auth.ClientCertPath,
+		key:      auth.ClientKeyPath,
+	}, nil
+}
+
+// remove removes the machine like docker-machine rm -f: a failure of the
+// driver is logged and the machine is removed from the store anyway.
+func (b *nativeBackend) remove(machineDir string, host *v3.Host, correlationID string) error {
+	hc, err := readHostConfig(machineDir, host.Hostname)
+	if err == errUnsupportedHost {
+		return b.fallback.remove(machineDir, host, correlationID)
+	} else if err != nil {
+		return err
+	}
+
+	err = withDriver(hc, func(driver *rpcdriver.RPCClientDriver) error {
+		return driver.Remove()
+	})
+	if err == errUnsupportedHost {
+		return b.fallback.remove(machineDir, host, correlationID)
+	} else if err != nil {
+		logger.WithField("resourceId", host.Id).Warnf("Driver failed to remove machine %s, removing it from the store: %v", host.Hostname, err)
+	}
+
+	return os.RemoveAll(filepath.Dir(hostConfigFile(machineDir, host.Hostname)))
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBackend records the machines the native backend falls back for.
+type recordingBackend struct {
+	calls []string
+}
+
+func (b *recordingBackend) exists(machineDir, name string) (bool, error) {
+	b.calls = append(b.calls, "exists "+name)
+	return true, nil
+}
+
+func (b *recordingBackend) state(machineDir, name string) (string, error) {
+	b.calls = append(b.calls, "state "+name)
+	return "Running", nil
+}
+
+func (b *recordingBackend) ip(machineDir, name string) (string, error) {
+	b.calls = append(b.calls, "ip "+name)
+	return "1.2.3.4", nil
+}
+
+func (b *recordingBackend) connectionConfig(machineDir, name string) (*tlsConnectionConfig, error) {
+	b.calls = append(b.calls, "config "+name)
+	return &tlsConnectionConfig{endpoint: "tcp://1.2.3.4:2376"}, nil
+}
+
+func (b *recordingBackend) remove(machineDir string, host *v3.Host, correlationID string) error {
+	b.calls = append(b.calls, "remove "+host.Hostname)
+	return nil
+}
+
+func writeHostConfig(t *testing.T, machineDir, name, content string) {
+	dir := filepath.Join(machineDir, "machines", name)
+	require.Nil(t, os.MkdirAll(dir, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(content), 0600))
+}
+
+func TestNativeBackend(t *testing.T) {
+	assert := require.New(t)
+
+	machineDir, err := ioutil.TempDir("", "gms-native")
+	assert.Nil(err)
+	defer os.RemoveAll(machineDir)
+
+	fallback := &recordingBackend{}
+	backend := &nativeBackend{fallback: fallback}
+
+	exists, err := backend.exists(machineDir, "host1")
+	assert.Nil(err)
+	assert.False(exists)
+
+	writeHostConfig(t, machineDir, "host1", `{"ConfigVersion": 1, "DriverName": "amazonec2", "Name": "host1"}`)
+	writeHostConfig(t, machineDir, "host2", `{"ConfigVersion": 3, "DriverName": "nosuchdriver", "Name": "host2", "Driver": {}}`)
+
+	exists, err = backend.exists(machineDir, "host1")
+	assert.Nil(err)
+	assert.True(exists)
+
+	// Old host configs and missing driver plugins are left to docker-machine
+	connConfig, err := backend.connectionConfig(machineDir, "host1")
+	assert.Nil(err)
+	assert.Equal("tcp://1.2.3.4:2376", connConfig.endpoint)
+	state, err := backend.state(machineDir, "host2")
+	assert.Nil(err)
+	assert.Equal("Running", state)
+	ip, err := backend.ip(machineDir, "host2")
+	assert.Nil(err)
+	assert.Equal("1.2.3.4", ip)
+	assert.Nil(backend.remove(machineDir, &v3.Host{Hostname: "host2"}, ""))
+	assert.Equal([]string{"config host1", "state host2", "ip host2", "remove host2"}, fallback.calls)
+
+	_, err = backend.state(machineDir, "host3")
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var errProvisionCanceled = errors.New("Provisioning canceled because the host is being removed")
+
+var operations = &operationRegistry{
+	running: map[string][]*operation{},
+}
+
+// operationRegistry holds the operations running for each host, so that
+// removing a host can cancel its provisioning.
+type operationRegistry struct {
+	sync.Mutex
+	running map[string][]*operation
+}
+
+// operation is a handler running for a host. Canceling it kills its running
+// docker-machine command, with the driver plugin, and wakes up its waits.
+type operation struct {
+	sync.Mutex
+	registry *operationRegistry
+	hostID   string
+	name     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	command  *exec.Cmd
+}
+
+// start registers an operation for the host. finish must be called once the
+// operation no longer uses the machine dir.
+func (r *operationRegistry) start(hostID, name string) *operation {
+	r.Lock()
+	defer r.Unlock()
+	return r.add(hostID, name)
+}
+
+// startOnce registers an operation for the host unless one of the same name
+// is already running, in which case it returns false.
+func (r *operationRegistry) startOnce(hostID, name string) (*operation, bool) {
+	r.Lock()
+	defer r.Unlock()
+	for _, op := range r.running[hostID] {
+		if op.name == name {
+			return nil, false
+		}
+	}
+	return r.add(hostID, name), true
+}
+
+func (r *operationRegistry) add(hostID, name string) *operation {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &operation{
+		registry: r,
+		hostID:   hostID,
+		name:     name,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	r.running[hostID] = append(r.running[hostID], op)
+	return op
+}
+
+// cancel cancels the named operations running for the host and returns them,
+// so that the caller can wait for them to finish.
+func (r *operationRegistry) cancel(hostID, name string) []*operation {
+	r.Lock()
+	defer r.Unlock()
+
+	canceled := []*operation{}
+	for _, op := range r.running[hostID] {
+		if op.name != name {
+			continue
+		}
+		op.cancel()
+		op.Lock()
+		if op.command != nil {
+			killCommand(op.command)
+		}
+		op.Unlock()
+		canceled = append(canceled, op)
+	}
+	return canceled
+}
+
+func (o *operation) finish() {
+	r := o.registry
+	r.Lock()
+	defer r.Unlock()
+
+	ops := r.running[o.hostID]
+	for i, op := range ops {
+		if op == o {
+			ops = append(ops[:i], ops[i+1:]...)
+			break
+		}
+	}
+	if len(ops) == 0 {
+		delete(r.running, o.hostID)
+	} else {
+		r.running[o.hostID] = ops
+	}
+	o.cancel()
+	close(o.done)
+}
+
+func (o *operation) canceled() bool {
+	return o.ctx.Err() != nil
+}
+
+// setCommand records the running docker-machine command, nil once it has
+// exited. A command started after the operation was canceled is killed at once.
+func (o *operation) setCommand(command *exec.Cmd) {
+	o.Lock()
+	defer o.Unlock()
+	o.command = command
+	if command != nil && o.canceled() {
+		killCommand(command)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationCancel(t *testing.T) {
+	assert := require.New(t)
+	registry := &operationRegistry{running: map[string][]*operation{}}
+
+	create := registry.start("1h1", createOperation)
+	other := registry.start("1h2", createOperation)
+	defer other.finish()
+
+	assert.Empty(registry.cancel("1h1", removeOperation))
+	assert.False(create.canceled())
+
+	command := exec.Command("sleep", "30")
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	assert.Nil(command.Start())
+	create.setCommand(command)
+
+	ops := registry.cancel("1h1", createOperation)
+	assert.Equal([]*operation{create}, ops)
+	assert.True(create.canceled())
+	assert.False(other.canceled())
+
+	// The command is killed rather than left to run to completion
+	exited := make(chan error)
+	go func() {
+		exited <- command.Wait()
+	}()
+	select {
+	case err := <-exited:
+		assert.NotNil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not killed")
+	}
+
+	create.finish()
+	<-ops[0].done
+	assert.Empty(registry.cancel("1h1", createOperation))
+	assert.Len(registry.running, 1)
+}
+
+func TestOperationCommandAfterCancel(t *testing.T) {
+	assert := require.New(t)
+	registry := &operationRegistry{running: map[string][]*operation{}}
+
+	op := registry.start("1h1", createOperation)
+	defer op.finish()
+	registry.cancel("1h1", createOperation)
+
+	command := exec.Command("sleep", "30")
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	assert.Nil(command.Start())
+	op.setCommand(command)
+	assert.NotNil(command.Wait())
+}
+
+func TestOperationStartOnce(t *testing.T) {
+	assert := require.New(t)
+	registry := &operationRegistry{running: map[string][]*operation{}}
+
+	op, ok := registry.startOnce("1h1", prePullOperation)
+	assert.True(ok)
+	_, ok = registry.startOnce("1h1", prePullOperation)
+	assert.False(ok)
+
+	op.finish()
+	op, ok = registry.startOnce("1h1", prePullOperation)
+	assert.True(ok)
+	op.finish()
+}
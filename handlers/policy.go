@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"golang.org/x/net/context"
+)
+
+// policyLabelPrefix labels override the policy of a phase for the host, such as
+// io.rancher.provision.agentRegistration=10m:3:30s. Host template labels apply
+// too, as templates copy their labels to the host.
+const policyLabelPrefix = "io.rancher.provision."
+
+// phaseTimeoutError is returned when a provisioning phase did not complete in time.
+type phaseTimeoutError struct {
+	phase   string
+	timeout time.Duration
+	err     error
+}
+
+func (e *phaseTimeoutError) Error() string {
+	msg := fmt.Sprintf("Timed out after %v in provisioning phase %s", e.timeout, e.phase)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// phasePolicy is the timeout and retry policy of a provisioning phase.
+type phasePolicy struct {
+	config.Phase
+	phase string
+}
+
+// provisionPolicy returns the policy of the phase for the host: the configured
+// one, overridden by the labels of the host. Invalid labels are ignored.
+func provisionPolicy(host *v3.Host, phase string, log *logrus.Entry) phasePolicy {
+	policy, _ := conf.Provisioning.Phase(phase)
+	if value, ok := host.Labels[policyLabelPrefix+phase].(string); ok {
+		override, err := config.ParsePhase(policy, value)
+		if err != nil {
+			log.Warnf("Ignoring label %s%s: %v", policyLabelPrefix, phase, err)
+		} else {
+			policy = override
+		}
+	}
+	return phasePolicy{Phase: policy, phase: phase}
+}
+
+// run calls attempt until it succeeds, waiting the backoff between attempts,
+// and returns the error of the last attempt once they are exhausted. attempt
+// must give up when its context is done, which happens when parent, the
+// context of the operation, is canceled or when the phase timeout expires.
+func (p phasePolicy) run(parent context.Context, attempt func(ctx context.Context) error) error {
+	ctx := parent
+	if p.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, p.Timeout.Duration)
+		defer cancel()
+	}
+
+	var err error
+	for i := 0; i < p.Attempts; i++ {
+		if i > 0 && p.Backoff.Duration > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.Backoff.Duration):
+			}
+		}
+		if ctx.Err() == nil {
+			if err = attempt(ctx); err == nil {
+				return nil
+			}
+		}
+		if parent.Err() != nil {
+			return errProvisionCanceled
+		}
+		if ctx.Err() != nil {
+			return &phaseTimeoutError{phase: p.phase, timeout: p.Timeout.Duration, err: err}
+		}
+	}
+	return err
+}
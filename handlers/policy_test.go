@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestProvisionPolicyLabels(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{Labels: map[string]interface{}{
+		policyLabelPrefix + config.PhaseAgentRegistration: "10m::5s",
+		policyLabelPrefix + config.PhaseAgentContainer:    "not a policy",
+	}}
+
+	policy := provisionPolicy(host, config.PhaseAgentRegistration, logger)
+	assert.Equal(10*time.Minute, policy.Timeout.Duration)
+	assert.Equal(conf.Provisioning.AgentRegistration.Attempts, policy.Attempts)
+	assert.Equal(5*time.Second, policy.Backoff.Duration)
+
+	policy = provisionPolicy(host, config.PhaseAgentContainer, logger)
+	assert.Equal(conf.Provisioning.AgentContainer, policy.Phase)
+}
+
+func TestPhasePolicyRun(t *testing.T) {
+	assert := require.New(t)
+	errNotReady := errors.New("not ready")
+
+	policy := phasePolicy{Phase: config.Phase{Attempts: 3}, phase: config.PhaseSaveConfig}
+	attempts := 0
+	err := policy.run(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return errNotReady
+	})
+	assert.Equal(errNotReady, err)
+	assert.Equal(3, attempts)
+
+	attempts = 0
+	err = policy.run(context.Background(), func(ctx context.Context) error {
+		attempts++
+		if attempts < 2 {
+			return errNotReady
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(2, attempts)
+
+	policy = phasePolicy{Phase: config.Phase{
+		Timeout:  config.Duration{Duration: 50 * time.Millisecond},
+		Attempts: 100,
+		Backoff:  config.Duration{Duration: 20 * time.Millisecond},
+	}, phase: config.PhaseAgentRegistration}
+	err = policy.run(context.Background(), func(ctx context.Context) error {
+		return errNotReady
+	})
+	assert.IsType(&phaseTimeoutError{}, err)
+	assert.Contains(err.Error(), config.PhaseAgentRegistration)
+	assert.Equal(errorClassAgentTimeout, errorClass(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = policy.run(ctx, func(ctx context.Context) error {
+		return errNotReady
+	})
+	assert.Equal(errProvisionCanceled, err)
+}
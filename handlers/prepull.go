@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-machine-service/config"
+	"github.com/rancher/go-machine-service/metrics"
+	v3 "github.com/rancher/go-rancher/v3"
+	"golang.org/x/net/context"
+)
+
+const (
+	prePullOperation = "prePull"
+	// prePullDataKey is the host data field the pre-pull report is written to.
+	prePullDataKey = "imagePrePull"
+
+	imagePending = "pending"
+	imagePulling = "pulling"
+	imageCached  = "cached"
+	imageFailed  = "failed"
+)
+
+var prePullTotal = metrics.NewCounter("gms_image_prepull_total",
+	"System image pre-pulls by result.", "result")
+
+// imagePull is the state of the pre-pull of an image.
+type imagePull struct {
+	State    string `json:"state"`
+	Percent  int    `json:"percent"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+
+	repo string
+	tag  string
+}
+
+// prePullReport is written to the host once its pre-pull is over.
+type prePullReport struct {
+	Images   map[string]*imagePull `json:"images"`
+	Cached   []string              `json:"cached"`
+	Finished time.Time             `json:"finished"`
+}
+
+// imagePrePull pulls the system images on the machine of a host, a bounded
+// number at once, retrying each as the image pre-pull phase policy allows.
+type imagePrePull struct {
+	sync.Mutex
+	host      *v3.Host
+	bootstrap agentBootstrap
+	auths     registryAuths
+	log       *logrus.Entry
+	images    map[string]*imagePull
+	order     []string
+}
+
+// newImagePrePull returns the pre-pull of the images, deduplicated by
+// reference. Images that can't be parsed are skipped.
+func newImagePrePull(host *v3.Host, bootstrap agentBootstrap, auths registryAuths, images []string, log *logrus.Entry) *imagePrePull {
+	p := &imagePrePull{
+		host:      host,
+		bootstrap: bootstrap,
+		auths:     auths,
+		log:       log,
+		images:    map[string]*imagePull{},
+	}
+	for _, image := range images {
+		repo, tag, err := parseImage(image)
+		if err != nil || repo == "" {
+			log.Debugf("Not pre-pulling image %q: %v", image, err)
+			continue
+		}
+		if tag == "" {
+			tag = "latest"
+		}
+		ref := repo + ":" + tag
+		if _, ok := p.images[ref]; ok {
+			continue
+		}
+		p.images[ref] = &imagePull{State: imagePending, repo: repo, tag: tag}
+		p.order = append(p.order, ref)
+	}
+	return p
+}
+
+// startImagePrePull pulls the system images of the cluster of the host, with
+// the credentials of their registry, in the background, unless a pre-pull
+// already runs for the host, and writes the report to the host once done. The
+// machine dir is kept until then.
+func startImagePrePull(host *v3.Host, hostDir string, bootstrap agentBootstrap, auths registryAuths, apiClient *v3.RancherClient, log *logrus.Entry) {
+	if conf.ImagePrePull.Workers <= 0 {
+		return
+	}
+	op, ok := operations.startOnce(host.Id, prePullOperation)
+	if !ok {
+		log.Info("Images are already being pre-pulled")
+		return
+	}
+	release := holdHostDir(hostDir)
+
+	go func() {
+		// The dir is released first, so that a remove waiting for the
+		// operation restores the machine dir once it is gone
+		defer op.finish()
+		defer release()
+
+		accountID, err := getAccountID(host, apiClient)
+		if err != nil {
+			log.Warnf("Failed to pre-pull images: %v", err)
+			return
+		}
+		images, err := collectImageNames(accountID, apiClient)
+		if err != nil {
+			log.Warnf("Failed to pre-pull images: %v", err)
+			return
+		}
+
+		p := newImagePrePull(host, bootstrap, auths, images, log)
+		report := p.run(op.ctx, conf.ImagePrePull.Workers)
+		if op.canceled() {
+			return
+		}
+		if _, err := writeHostData(host.Id, prePullDataKey, report, apiClient); err != nil {
+			log.Warnf("Failed to write image pre-pull report: %v", err)
+		}
+		log.Infof("Pre-pulled images: %d of %d cached", len(report.Cached), len(report.Images))
+	}()
+}
+
+// run pulls the images with the given number of workers and returns the report.
+func (p *imagePrePull) run(ctx context.Context, workers int) *prePullReport {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range queue {
+				p.pull(ctx, ref)
+			}
+		}()
+	}
+	for _, ref := range p.order {
+		queue <- ref
+	}
+	close(queue)
+	wg.Wait()
+
+	return p.report()
+}
+
+func (p *imagePrePull) pull(ctx context.Context, ref string) {
+	p.Lock()
+	image := p.images[ref]
+	image.State = imagePulling
+	p.Unlock()
+	log := p.log.WithField("image", ref)
+
+	err := provisionPolicy(p.host, config.PhaseImagePrePull, log).run(ctx, func(ctx context.Context) error {
+		p.Lock()
+		image.Attempts++
+		p.Unlock()
+		return p.bootstrap.pullImage(ctx, image.repo, image.tag, p.auths.forImage(image.repo), func(percent int) {
+			p.Lock()
+			previous := image.Percent
+			image.Percent = percent
+			p.Unlock()
+			// Log every quarter rather than each layer update
+			if percent/25 > previous/25 {
+				log.Debugf("Pulling image: %d%%", percent)
+			}
+		})
+	})
+
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		image.State = imageFailed
+		image.Error = err.Error()
+		log.Warnf("Failed to pre-pull image: %v", err)
+		prePullTotal.Inc(resultError)
+		return
+	}
+	image.State = imageCached
+	image.Percent = 100
+	log.Info("Pre-pulled image")
+	prePullTotal.Inc(resultSuccess)
+}
+
+func (p *imagePrePull) report() *prePullReport {
+	p.Lock()
+	defer p.Unlock()
+	report := &prePullReport{
+		Images:   map[string]*imagePull{},
+		Cached:   []string{},
+		Finished: time.Now().UTC(),
+	}
+	for ref, image := range p.images {
+		copied := *image
+		report.Images[ref] = &copied
+		if image.State == imageCached {
+			report.Cached = append(report.Cached, ref)
+		}
+	}
+	sort.Strings(report.Cached)
+	return report
+}
+
+// pullMessage is a message of the JSON stream of an image pull.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// decodePullStream reads the JSON stream of an image pull until it ends,
+// calling progress, if set, with the percentage of the layers downloaded. It
+// returns the error the stream reports, as the pull itself succeeds even when
+// the image can't be pulled.
+func decodePullStream(r io.Reader, progress func(int)) error {
+	type layer struct {
+		current, total int64
+	}
+	layers := map[string]*layer{}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var m pullMessage
+		if err := decoder.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "Reading image pull")
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+		if m.ID == "" || progress == nil {
+			continue
+		}
+
+		l, ok := layers[m.ID]
+		if !ok {
+			l = &layer{}
+			layers[m.ID] = l
+		}
+		switch m.Status {
+		case "Downloading":
+			l.current, l.total = m.ProgressDetail.Current, m.ProgressDetail.Total
+		case "Download complete", "Pull complete", "Already exists":
+			if l.total == 0 {
+				l.total = 1
+			}
+			l.current = l.total
+		default:
+			continue
+		}
+
+		var current, total int64
+		for _, l := range layers {
+			current += l.current
+			total += l.total
+		}
+		if total > 0 {
+			progress(int(current * 100 / total))
+		}
+	}
+}
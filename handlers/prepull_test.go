@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// pullBootstrap is an agentBootstrap that only pulls, failing the pulls of
+// the images in fail.
+type pullBootstrap struct {
+	sync.Mutex
+	fail    map[string]bool
+	pulls   map[string]int
+	running int
+	maxRun  int
+	authed  []string
+}
+
+func (b *pullBootstrap) strategy() string { return "test" }
+
+func (b *pullBootstrap) pullImage(ctx context.Context, imageRepo, imageTag string, auth *types.AuthConfig, progress func(int)) error {
+	ref := imageRepo + ":" + imageTag
+	b.Lock()
+	b.pulls[ref]++
+	if auth != nil {
+		b.authed = append(b.authed, ref)
+	}
+	b.running++
+	if b.running > b.maxRun {
+		b.maxRun = b.running
+	}
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		b.running--
+		b.Unlock()
+	}()
+
+	if b.fail[ref] {
+		return errors.New("pull access denied")
+	}
+	progress(50)
+	return nil
+}
+
+func (b *pullBootstrap) createContainer(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, name string) (string, error) {
+	return "", nil
+}
+func (b *pullBootstrap) startContainer(ctx context.Context, id string) error { return nil }
+func (b *pullBootstrap) containerRunning(ctx context.Context, name string) (bool, error) {
+	return true, nil
+}
+func (b *pullBootstrap) removeContainer(ctx context.Context, id string) error           { return nil }
+func (b *pullBootstrap) watch(ctx context.Context, names []string, d *agentDiagnostics) {}
+
+func TestImagePrePull(t *testing.T) {
+	assert := require.New(t)
+
+	bootstrap := &pullBootstrap{
+		fail:  map[string]bool{"rancher/private:v1": true},
+		pulls: map[string]int{},
+	}
+	host := &v3.Host{Labels: map[string]interface{}{
+		policyLabelPrefix + "imagePrePull": "1m:2:0s",
+	}}
+	auths := registryAuths{"registry.example.com": {Username: "deploy"}}
+	p := newImagePrePull(host, bootstrap, auths, []string{
+		"rancher/net:v0.13.5",
+		"rancher/dns:v0.15.3",
+		"rancher/net:v0.13.5",
+		"rancher/healthcheck",
+		"rancher/private:v1",
+		"registry.example.com/rancher/agent:v2.0",
+		"Invalid Image",
+	}, logger.WithField("test", "TestImagePrePull"))
+	assert.Equal([]string{"rancher/net:v0.13.5", "rancher/dns:v0.15.3", "rancher/healthcheck:latest", "rancher/private:v1", "registry.example.com/rancher/agent:v2.0"}, p.order)
+
+	report := p.run(context.Background(), 2)
+	assert.True(bootstrap.maxRun <= 2)
+	assert.Equal(1, bootstrap.pulls["rancher/net:v0.13.5"])
+	assert.Equal(2, bootstrap.pulls["rancher/private:v1"])
+	assert.Equal([]string{"rancher/dns:v0.15.3", "rancher/healthcheck:latest", "rancher/net:v0.13.5", "registry.example.com/rancher/agent:v2.0"}, report.Cached)
+	assert.Equal([]string{"registry.example.com/rancher/agent:v2.0"}, bootstrap.authed)
+	assert.Equal(imageFailed, report.Images["rancher/private:v1"].State)
+	assert.Equal(2, report.Images["rancher/private:v1"].Attempts)
+	assert.Equal(100, report.Images["rancher/dns:v0.15.3"].Percent)
+}
+
+func TestDecodePullStream(t *testing.T) {
+	assert := require.New(t)
+
+	stream := `{"status":"Pulling from rancher/agent","id":"v2.0"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a"}
+{"status":"Downloading","progressDetail":{"current":50,"total":100},"id":"a"}
+{"status":"Downloading","progressDetail":{"current":0,"total":300},"id":"b"}
+{"status":"Download complete","progressDetail":{},"id":"a"}
+{"status":"Downloading","progressDetail":{"current":300,"total":300},"id":"b"}
+{"status":"Status: Downloaded newer image for rancher/agent:v2.0"}
+`
+	percents := []int{}
+	assert.Nil(decodePullStream(strings.NewReader(stream), func(percent int) {
+		percents = append(percents, percent)
+	}))
+	assert.Equal([]int{50, 12, 25, 100}, percents)
+
+	err := decodePullStream(strings.NewReader(`{"error":"pull access denied for rancher/private"}`), nil)
+	assert.EqualError(err, "pull access denied for rancher/private")
+}
+
+func TestHoldHostDir(t *testing.T) {
+	assert := require.New(t)
+
+	hostDir, err := ioutil.TempDir("", "gms-hold")
+	assert.Nil(err)
+	defer os.RemoveAll(hostDir)
+
+	release := holdHostDir(hostDir)
+	releaseOther := holdHostDir(hostDir)
+	release()
+	release()
+	_, err = os.Stat(hostDir)
+	assert.Nil(err)
+
+	releaseOther()
+	_, err = os.Stat(hostDir)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"strings"
+)
+
+const (
+	phaseQueued           = "queued"
+	phaseCreatingVM       = "creating_vm"
+	phaseWaitingForIP     = "waiting_for_ip"
+	phaseSSHAvailable     = "ssh_available"
+	phaseInstallingEngine = "installing_engine"
+	phaseCopyingCerts     = "copying_certs"
+	phaseConfiguringAuth  = "configuring_auth"
+	phaseRunningHooks     = "running_hooks"
+)
+
+// provisionPhases are the phases of a host provisioning, in order.
+var provisionPhases = []string{
+	phaseQueued,
+	phaseContactingDriver,
+	phaseCreatingVM,
+	phaseWaitingForIP,
+	phaseSSHAvailable,
+	phaseInstallingEngine,
+	phaseCopyingCerts,
+	phaseConfiguringAuth,
+	phaseRunningHooks,
+	phaseInstallingAgent,
+	phaseWaitingForAgent,
+}
+
+// machinePhases maps the start of docker-machine create output lines to the
+// phase they begin.
+var machinePhases = []struct {
+	prefix string
+	phase  string
+}{
+	{"Running pre-create checks", phaseCreatingVM},
+	{"Creating machine", phaseCreatingVM},
+	{"Waiting for machine to be running", phaseWaitingForIP},
+	{"Detecting operating system", phaseSSHAvailable},
+	{"Waiting for SSH to be available", phaseSSHAvailable},
+	{"Detecting the provisioner", phaseSSHAvailable},
+	{"Provisioning with", phaseInstallingEngine},
+	{"Installing Docker", phaseInstallingEngine},
+	{"Copying certs", phaseCopyingCerts},
+	{"Setting Docker configuration", phaseConfiguringAuth},
+	{"Checking connection to Docker", phaseConfiguringAuth},
+}
+
+// progress is a provisioning message sent to the republisher. An empty phase
+// means the message belongs to the current phase.
+type progress struct {
+	phase   string
+	message string
+}
+
+// machinePhase returns the phase a docker-machine output line begins, or "".
+func machinePhase(line string) string {
+	for _, p := range machinePhases {
+		if strings.HasPrefix(line, p.prefix) {
+			return p.phase
+		}
+	}
+	return ""
+}
+
+// progressStatus is published in the reply data, under "progress", along with
+// the transitioning message.
+type progressStatus struct {
+	Phase   string `json:"phase"`
+	Step    int    `json:"step"`
+	Total   int    `json:"total"`
+	Percent int    `json:"percent"`
+	Message string `json:"message"`
+}
+
+// advance returns the status after p. Phases never go back, so a line that
+// looks like an earlier phase only updates the message.
+func (s progressStatus) advance(p progress) progressStatus {
+	s.Message = p.message
+	s.Total = len(provisionPhases)
+	for i, phase := range provisionPhases {
+		if phase == p.phase && i+1 > s.Step {
+			s.Phase = phase
+			s.Step = i + 1
+		}
+	}
+	if s.Step > 0 {
+		s.Percent = (s.Step - 1) * 100 / s.Total
+	}
+	return s
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressStatus(t *testing.T) {
+	assert := require.New(t)
+
+	status := progressStatus{}
+	status = status.advance(progress{phaseContactingDriver, "Contacting amazonec2"})
+	assert.Equal(progressStatus{Phase: phaseContactingDriver, Step: 2, Total: 11, Percent: 9, Message: "Contacting amazonec2"}, status)
+
+	line := "Waiting for machine to be running, this may take a few minutes..."
+	status = status.advance(progress{machinePhase(line), line})
+	assert.Equal(phaseWaitingForIP, status.Phase)
+	assert.Equal(4, status.Step)
+
+	// Lines of no known phase, or of an earlier one, stay in the current phase
+	status = status.advance(progress{machinePhase("(host1) Launching instance..."), "(host1) Launching instance..."})
+	assert.Equal(phaseWaitingForIP, status.Phase)
+	assert.Equal("(host1) Launching instance...", status.Message)
+	status = status.advance(progress{machinePhase("Creating machine..."), "Creating machine..."})
+	assert.Equal(phaseWaitingForIP, status.Phase)
+
+	status = status.advance(progress{phaseWaitingForAgent, "Waiting for agent initialization"})
+	assert.Equal(11, status.Step)
+	assert.Equal(90, status.Percent)
+}
+
+func TestMachinePhase(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(phaseCreatingVM, machinePhase("Running pre-create checks..."))
+	assert.Equal(phaseSSHAvailable, machinePhase("Detecting the provisioner..."))
+	assert.Equal(phaseInstallingEngine, machinePhase("Installing Docker..."))
+	assert.Equal(phaseCopyingCerts, machinePhase("Copying certs to the remote machine..."))
+	assert.Equal(phaseConfiguringAuth, machinePhase("Setting Docker configuration on the remote daemon..."))
+	assert.Equal("", machinePhase("Docker is up and running!"))
+}
@@ -3,6 +3,7 @@ package providers
 import (
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v3"
 )
 
@@ -16,7 +17,7 @@ func init() {
 type AmazonEC2Handler struct {
 }
 
-func (*AmazonEC2Handler) HandleCreate(host *client.Host, hostDir string) error {
+func (*AmazonEC2Handler) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	return nil
 }
 
@@ -28,3 +29,7 @@ func (*AmazonEC2Handler) HandleError(msg string) string {
 	}
 	return prettyMsg
 }
+
+func (*AmazonEC2Handler) UserData() UserData {
+	return UserData{Field: "userdata", Path: true}
+}
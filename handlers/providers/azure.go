@@ -7,6 +7,7 @@ import (
 
 	"errors"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-machine-service/logging"
 	"github.com/rancher/go-rancher/v3"
 )
@@ -23,7 +24,7 @@ func init() {
 type AzureHandler struct {
 }
 
-func (*AzureHandler) HandleCreate(host *client.Host, hostDir string) error {
+func (*AzureHandler) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	var filename string
 	fields := host.Data["fields"]
 	if fields == nil {
@@ -37,7 +38,7 @@ func (*AzureHandler) HandleCreate(host *client.Host, hostDir string) error {
 	if _, ok := machineConfig["subscriptionCert"]; ok {
 		value := machineConfig["subscriptionCert"].(string)
 		filename = "subscription-cert.pem"
-		path, err := saveDataToFile(filename, value, hostDir)
+		path, err := saveDataToFile(filename, value, hostDir, log)
 		if err != nil {
 			return err
 		}
@@ -45,7 +46,7 @@ func (*AzureHandler) HandleCreate(host *client.Host, hostDir string) error {
 	} else if _, ok := machineConfig["publishSettingsFile"]; ok {
 		value := machineConfig["publishSettingsFile"].(string)
 		filename = "publish-settings.xml"
-		path, err := saveDataToFile(filename, value, hostDir)
+		path, err := saveDataToFile(filename, value, hostDir, log)
 		if err != nil {
 			return err
 		}
@@ -58,7 +59,12 @@ func (*AzureHandler) HandleError(msg string) string {
 	return msg
 }
 
-func saveDataToFile(filename, data, machineDir string) (string, error) {
+func (*AzureHandler) UserData() UserData {
+	return UserData{}
+}
+
+func saveDataToFile(filename, data, machineDir string, log *logrus.Entry) (string, error) {
+	log.Debugf("Saving %s to %s", filename, machineDir)
 	f, err := os.Create(filepath.Join(machineDir, filename))
 	defer f.Close()
 	if err != nil {
@@ -26,7 +26,7 @@ func TestAzureHandler(t *testing.T) {
 
 	azureHandler := &AzureHandler{}
 
-	err := azureHandler.HandleCreate(machine, machineDir)
+	err := azureHandler.HandleCreate(machine, machineDir, logger)
 
 	if err != nil {
 		t.Errorf("could not save subscriptionCert to path, err=%v", err)
@@ -69,7 +69,7 @@ func TestAzureHandler_DM_0_7(t *testing.T) {
 
 	azureHandler := &AzureHandler{}
 
-	err := azureHandler.HandleCreate(machine, machineDir)
+	err := azureHandler.HandleCreate(machine, machineDir, logger)
 
 	if err != nil {
 		t.Errorf("not Docker Machine 0.7.0 ready, err=%v", err)
@@ -3,6 +3,7 @@ package providers
 import (
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v3"
 )
 
@@ -16,7 +17,7 @@ func init() {
 type DigitaloceanHandler struct {
 }
 
-func (*DigitaloceanHandler) HandleCreate(host *client.Host, hostDir string) error {
+func (*DigitaloceanHandler) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	return nil
 }
 
@@ -27,3 +28,7 @@ func (*DigitaloceanHandler) HandleError(msg string) string {
 	}
 	return prettyMsg
 }
+
+func (*DigitaloceanHandler) UserData() UserData {
+	return UserData{Field: "userdata", Path: true}
+}
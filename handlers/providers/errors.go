@@ -0,0 +1,38 @@
+package providers
+
+import (
+	"regexp"
+)
+
+const (
+	ErrorClassAuthentication = "authentication"
+	ErrorClassThrottled      = "throttled"
+	ErrorClassQuota          = "quota"
+	ErrorClassNotFound       = "not_found"
+	ErrorClassTimeout        = "timeout"
+	ErrorClassNetwork        = "network"
+	ErrorClassUnknown        = "unknown"
+)
+
+var errorClasses = []struct {
+	class   string
+	pattern *regexp.Regexp
+}{
+	{ErrorClassAuthentication, regexp.MustCompile(`(?i)\b401\b|\b403\b|unauthori[sz]ed|forbidden|authfailure|invalid (api ?key|token|credentials|username)`)},
+	{ErrorClassThrottled, regexp.MustCompile(`(?i)\b429\b|throttl|rate ?limit|requestlimitexceeded|too many requests`)},
+	{ErrorClassQuota, regexp.MustCompile(`(?i)quota|limit ?exceeded|insufficient`)},
+	{ErrorClassNotFound, regexp.MustCompile(`(?i)\b404\b|not found|does not exist|invalid (id|project|image|region)`)},
+	{ErrorClassTimeout, regexp.MustCompile(`(?i)timeout|timed out|deadline exceeded`)},
+	{ErrorClassNetwork, regexp.MustCompile(`(?i)connection refused|connection reset|no such host|network is unreachable|\beof\b`)},
+}
+
+// ErrorClass maps an error message, as returned by Provider.HandleError, to one
+// of a small set of classes suitable for use as a metric label.
+func ErrorClass(msg string) string {
+	for _, c := range errorClasses {
+		if c.pattern.MatchString(msg) {
+			return c.class
+		}
+	}
+	return ErrorClassUnknown
+}
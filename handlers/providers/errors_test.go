@@ -0,0 +1,23 @@
+package providers
+
+import (
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	for msg, expected := range map[string]string{
+		"Invalid username or apiKey":                                   ErrorClassAuthentication,
+		"Invalid API key":                                              ErrorClassAuthentication,
+		"RequestLimitExceeded: Request limit exceeded.":                ErrorClassThrottled,
+		"InstanceLimitExceeded: You have requested more instances":     ErrorClassQuota,
+		"Invalid project":                                              ErrorClassNotFound,
+		"\"Invalid id: ami-15434343\"":                                 ErrorClassNotFound,
+		"Too many retries waiting for SSH to be available. Last error": ErrorClassUnknown,
+		"dial tcp 10.0.0.1:22: i/o timeout":                            ErrorClassTimeout,
+		"dial tcp: lookup api.packet.net: no such host":                ErrorClassNetwork,
+	} {
+		if actual := ErrorClass(msg); actual != expected {
+			t.Errorf("expected %s for %q, but got %s", expected, msg, actual)
+		}
+	}
+}
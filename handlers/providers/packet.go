@@ -3,6 +3,7 @@ package providers
 import (
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v3"
 )
 
@@ -16,7 +17,7 @@ func init() {
 type PacketHandler struct {
 }
 
-func (*PacketHandler) HandleCreate(host *client.Host, hostDir string) error {
+func (*PacketHandler) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	return nil
 }
 
@@ -30,3 +31,7 @@ func (*PacketHandler) HandleError(msg string) string {
 	}
 	return prettyMsg
 }
+
+func (*PacketHandler) UserData() UserData {
+	return UserData{Field: "userdata", Path: true}
+}
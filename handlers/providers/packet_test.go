@@ -28,3 +28,13 @@ func TestPacketErrorHandler(t *testing.T) {
 		t.Errorf("expected %s, but got %s", expectedPrettyMessage, actualPrettyMessage)
 	}
 }
+
+func TestPacketUserData(t *testing.T) {
+	userData := (&PacketHandler{}).UserData()
+	if userData.Field != "userdata" || !userData.Path {
+		t.Errorf("expected userdata path flag, but got %+v", userData)
+	}
+	if (&DefaultProvider{}).UserData().Supported() {
+		t.Errorf("expected no user data flag for the default provider")
+	}
+}
@@ -3,19 +3,36 @@ package providers
 import (
 	"fmt"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v3"
 )
 
 type Provider interface {
-	HandleCreate(host *client.Host, hostDir string) error
+	HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error
 
 	HandleError(msg string) string
+
+	UserData() UserData
+}
+
+// UserData is how a driver takes user data, such as a cloud-init config, at
+// create time. Field is the driver config field the create flag is built from
+// and Path is set if the flag expects a file rather than the content. Drivers
+// with no such flag return the zero value.
+type UserData struct {
+	Field string
+	Path  bool
+}
+
+// Supported returns whether the driver takes user data at create time.
+func (u UserData) Supported() bool {
+	return u.Field != ""
 }
 
 type DefaultProvider struct {
 }
 
-func (*DefaultProvider) HandleCreate(host *client.Host, hostDir string) error {
+func (*DefaultProvider) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	return nil
 }
 
@@ -23,6 +40,10 @@ func (*DefaultProvider) HandleError(msg string) string {
 	return msg
 }
 
+func (*DefaultProvider) UserData() UserData {
+	return UserData{}
+}
+
 var (
 	providers map[string]Provider
 )
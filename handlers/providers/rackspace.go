@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher/v3"
 )
 
@@ -14,7 +15,7 @@ func init() {
 type RackspaceHandler struct {
 }
 
-func (*RackspaceHandler) HandleCreate(host *client.Host, hostDir string) error {
+func (*RackspaceHandler) HandleCreate(host *client.Host, hostDir string, log *logrus.Entry) error {
 	return nil
 }
 
@@ -25,3 +26,7 @@ func (*RackspaceHandler) HandleError(msg string) string {
 	}
 	return prettyMsg
 }
+
+func (*RackspaceHandler) UserData() UserData {
+	return UserData{}
+}
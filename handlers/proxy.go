@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// httpProxyField, httpsProxyField and noProxyField are the host template
+	// values overriding the configured proxy of its hosts.
+	httpProxyField  = "httpProxy"
+	httpsProxyField = "httpsProxy"
+	noProxyField    = "noProxy"
+)
+
+// hostProxy returns the proxy of the engine and the agent of the host, its
+// template already applied. Cattle is always reached directly, as the agent
+// registers with it over the network of the machine.
+func hostProxy(host *v3.Host) config.Proxy {
+	proxy := conf.Proxy
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	for field, value := range map[string]*string{
+		httpProxyField:  &proxy.HTTPProxy,
+		httpsProxyField: &proxy.HTTPSProxy,
+		noProxyField:    &proxy.NoProxy,
+	} {
+		if s, _ := fields[field].(string); s != "" {
+			*value = s
+		}
+	}
+	if !proxy.Enabled() {
+		return proxy
+	}
+	if u, err := url.Parse(conf.CattleURL); err == nil && config.Hostname(u) != "" {
+		proxy = proxy.WithNoProxy(config.Hostname(u))
+	}
+	return proxy
+}
+
+// proxyEngineEnv returns the proxy variables of the engine of the host, but
+// those its engine env already sets, in either case, so that the engine
+// doesn't get two values of one variable.
+func proxyEngineEnv(host *v3.Host) []string {
+	env := []string{}
+	for _, variable := range hostProxy(host).Env() {
+		key := strings.SplitN(variable, "=", 2)[0]
+		_, upper := host.EngineEnv[strings.ToUpper(key)]
+		_, lower := host.EngineEnv[strings.ToLower(key)]
+		if upper || lower {
+			continue
+		}
+		env = append(env, variable)
+	}
+	return env
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostProxy(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(proxy config.Proxy, cattleURL string) {
+		conf.Proxy, conf.CattleURL = proxy, cattleURL
+	}(conf.Proxy, conf.CattleURL)
+	conf.Proxy = config.Proxy{HTTPProxy: "http://proxy:3128", NoProxy: "localhost"}
+	conf.CattleURL = "http://cattle.example.com:8080/v3"
+
+	host := &v3.Host{Data: map[string]interface{}{"fields": map[string]interface{}{}}}
+	assert.Equal(config.Proxy{
+		HTTPProxy: "http://proxy:3128",
+		NoProxy:   "localhost,cattle.example.com",
+	}, hostProxy(host))
+
+	host.Data["fields"].(map[string]interface{})[httpsProxyField] = "http://template-proxy:3128"
+	host.Data["fields"].(map[string]interface{})[noProxyField] = "10.0.0.0/8"
+	assert.Equal(config.Proxy{
+		HTTPProxy:  "http://proxy:3128",
+		HTTPSProxy: "http://template-proxy:3128",
+		NoProxy:    "10.0.0.0/8,cattle.example.com",
+	}, hostProxy(host))
+
+	conf.Proxy = config.Proxy{}
+	assert.Nil(hostProxy(&v3.Host{}).Env())
+}
+
+func TestProxyEnv(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(proxy config.Proxy, cattleURL string) {
+		conf.Proxy, conf.CattleURL = proxy, cattleURL
+	}(conf.Proxy, conf.CattleURL)
+	conf.Proxy = config.Proxy{HTTPProxy: "http://proxy:3128"}
+	conf.CattleURL = "http://cattle:8080/v3"
+
+	host := &v3.Host{
+		Uuid:      "uuid1",
+		EngineEnv: map[string]interface{}{"HTTP_PROXY": "http://engine-proxy:3128"},
+	}
+	assert.Equal([]string{
+		"NO_PROXY=cattle",
+		"no_proxy=cattle",
+	}, proxyEngineEnv(host))
+
+	host.EngineEnv = map[string]interface{}{"no_proxy": "localhost"}
+	assert.Equal([]string{
+		"HTTP_PROXY=http://proxy:3128",
+		"http_proxy=http://proxy:3128",
+	}, proxyEngineEnv(host))
+
+	config := buildContainerConfig([]string{"http://cattle:8080/v3/scripts/token"}, host, "rancher/agent", "v2.0")
+	assert.Equal([]string{
+		"CATTLE_PHYSICAL_HOST_UUID=uuid1",
+		"HTTP_PROXY=http://proxy:3128",
+		"http_proxy=http://proxy:3128",
+		"NO_PROXY=cattle",
+		"no_proxy=cattle",
+	}, config.Env)
+}
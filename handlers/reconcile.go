@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-machine-service/dynamic"
+	"github.com/rancher/go-machine-service/metrics"
+	client "github.com/rancher/go-rancher/v3"
+)
+
+const provisioningState = "provisioning"
+
+var stuckHostsGauge = metrics.NewGauge("gms_stuck_hosts",
+	"Hosts provisioning for longer than the stuck host timeout without a handler.")
+
+// Reconciler periodically repairs missing machine drivers and finds hosts that
+// are stuck provisioning, for example because the instance handling them died.
+type Reconciler struct {
+	apiClient *client.RancherClient
+	// seen is when this reconciler restarted the provisioning of each host,
+	// or first saw it provisioning if the host tells no time
+	seen map[string]time.Time
+	now  func() time.Time
+}
+
+func NewReconciler(apiClient *client.RancherClient) *Reconciler {
+	return &Reconciler{
+		apiClient: apiClient,
+		seen:      map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+// Run reconciles at the configured interval until stop is closed.
+func (r *Reconciler) Run(stop <-chan struct{}) {
+	interval := conf.Reconcile.Interval.Duration
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := dynamic.ReconcileDrivers(); err != nil {
+			logger.Errorf("Error reconciling drivers: %v", err)
+		}
+		if err := r.ReconcileHosts(); err != nil {
+			logger.Errorf("Error reconciling hosts: %v", err)
+		}
+		if err := pruneTranscripts(); err != nil {
+			logger.Errorf("Error pruning provisioning logs: %v", err)
+		}
+	}
+}
+
+// ReconcileHosts reports the hosts that have been provisioning for longer than
+// the stuck host timeout with no handler running for them on this instance and
+// no lease held by another instance. If configured, their provisioning is
+// restarted through Cattle.
+func (r *Reconciler) ReconcileHosts() error {
+	opts := client.NewListOpts()
+	opts.Filters["state"] = provisioningState
+	opts.Filters["removed_null"] = "true"
+
+	hosts, err := r.apiClient.Host.List(opts)
+	if err != nil {
+		return err
+	}
+
+	now := r.now()
+	provisioning := map[string]bool{}
+	stuck := 0
+	for _, host := range hosts.Data {
+		if Handling(host.Id) || getLease(&host).heldByOther(conf.Leases.InstanceID, now) {
+			continue
+		}
+
+		provisioning[host.Id] = true
+		since, ok := stuckSince(&host, r.seen[host.Id])
+		if !ok {
+			r.seen[host.Id] = now
+			continue
+		}
+		if now.Sub(since) < conf.Reconcile.StuckHostTimeout.Duration {
+			continue
+		}
+
+		stuck++
+		log := logger.WithFields(logrus.Fields{
+			"resourceId":           host.Id,
+			"transitioningMessage": host.TransitioningMessage,
+		})
+		if !conf.Reconcile.RetryStuckHosts {
+			log.Warnf("Host has been provisioning without a handler since %v", since)
+			continue
+		}
+
+		log.Warn("Host is stuck provisioning, restarting provisioning")
+		if _, err := r.apiClient.Host.ActionProvision(&host); err != nil {
+			log.Errorf("Failed to restart provisioning: %v", err)
+			continue
+		}
+		r.seen[host.Id] = now
+	}
+
+	for id := range r.seen {
+		if !provisioning[id] {
+			delete(r.seen, id)
+		}
+	}
+	stuckHostsGauge.Set(float64(stuck))
+	return nil
+}
+
+// stuckSince returns since when the host has been provisioning without a
+// handler, as far as it tells, so that a restart of the service does not
+// count again from zero: the latest of when it was created, when its lease
+// expired and seen, when this reconciler restarted its provisioning. It
+// returns false if none is known.
+func stuckSince(host *client.Host, seen time.Time) (time.Time, bool) {
+	since := seen
+	if created, err := time.Parse(time.RFC3339, host.Created); err == nil && created.After(since) {
+		since = created
+	}
+	if l := getLease(host); l != nil && l.Expires.After(since) {
+		since = l.Expires
+	}
+	return since, !since.IsZero()
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	client "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStuckSince(t *testing.T) {
+	assert := require.New(t)
+
+	created := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+	host := &client.Host{Created: created.Format(time.RFC3339)}
+	since, ok := stuckSince(host, time.Time{})
+	assert.True(ok)
+	assert.True(created.Equal(since))
+
+	// The handler that held the lease was alive until it expired
+	expired := created.Add(time.Hour)
+	host.Data = map[string]interface{}{
+		leaseDataKey: map[string]interface{}{"owner": "gms-1", "expires": expired.Format(time.RFC3339)},
+	}
+	since, _ = stuckSince(host, time.Time{})
+	assert.True(expired.Equal(since))
+
+	restarted := created.Add(2 * time.Hour)
+	since, _ = stuckSince(host, restarted)
+	assert.True(restarted.Equal(since))
+
+	_, ok = stuckSince(&client.Host{}, time.Time{})
+	assert.False(ok)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// registryCredentialsField is the host template secret value mapping
+	// registry hosts to their credentials, such as
+	// {"registry.example.com": {"username": "deploy", "password": "..."}}.
+	registryCredentialsField = "registryCredentials"
+	dockerHubRegistry        = "docker.io"
+)
+
+// registryAuths are the credentials of the registries, by normalized host.
+type registryAuths map[string]types.AuthConfig
+
+// resolveRegistryAuths returns the credentials the images of the host are
+// pulled with: the registry credentials of its cluster, overridden by those
+// of the secret values of its host template.
+func resolveRegistryAuths(host *v3.Host, apiClient *v3.RancherClient) (registryAuths, error) {
+	filters := map[string]interface{}{
+		"clusterId":    host.ClusterId,
+		"removed_null": true,
+		"state":        "active",
+	}
+	registries, err := apiClient.Registry.List(&v3.ListOpts{Filters: filters})
+	if err != nil {
+		return nil, errors.Wrap(err, "Listing registries")
+	}
+	credentials, err := apiClient.RegistryCredential.List(&v3.ListOpts{Filters: filters})
+	if err != nil {
+		return nil, errors.Wrap(err, "Listing registry credentials")
+	}
+	auths := cattleRegistryAuths(registries.Data, credentials.Data)
+
+	if host.HostTemplateId != "" {
+		ht, err := apiClient.HostTemplate.ById(host.HostTemplateId)
+		if err != nil {
+			return nil, err
+		}
+		if ht != nil {
+			secretValues := map[string]interface{}{}
+			if err := apiClient.GetLink(ht.Resource, "secretValues", &secretValues); err != nil {
+				return nil, errors.Wrap(err, "Get secretValues link")
+			}
+			for server, auth := range templateRegistryAuths(secretValues) {
+				auths[server] = auth
+			}
+		}
+	}
+	return auths, nil
+}
+
+// cattleRegistryAuths returns the credentials of the registries they belong to.
+func cattleRegistryAuths(registries []v3.Registry, credentials []v3.RegistryCredential) registryAuths {
+	servers := map[string]string{}
+	for _, registry := range registries {
+		servers[registry.Id] = registry.ServerAddress
+	}
+	auths := registryAuths{}
+	for _, credential := range credentials {
+		server, ok := servers[credential.RegistryId]
+		if !ok || server == "" {
+			continue
+		}
+		auths[normalizeRegistry(server)] = types.AuthConfig{
+			Username:      credential.PublicValue,
+			Password:      credential.SecretValue,
+			ServerAddress: server,
+		}
+	}
+	return auths
+}
+
+// templateRegistryAuths returns the credentials of the registryCredentials
+// field of the secret values of a host template.
+func templateRegistryAuths(secretValues map[string]interface{}) registryAuths {
+	auths := registryAuths{}
+	servers, _ := secretValues[registryCredentialsField].(map[string]interface{})
+	for server, value := range servers {
+		credential, _ := value.(map[string]interface{})
+		username, _ := credential["username"].(string)
+		password, _ := credential["password"].(string)
+		if username == "" {
+			continue
+		}
+		auths[normalizeRegistry(server)] = types.AuthConfig{
+			Username:      username,
+			Password:      password,
+			ServerAddress: server,
+		}
+	}
+	return auths
+}
+
+// forImage returns the credentials of the registry of the image repo, or nil.
+func (a registryAuths) forImage(imageRepo string) *types.AuthConfig {
+	named, err := reference.ParseNormalizedNamed(imageRepo)
+	if err != nil {
+		return nil
+	}
+	auth, ok := a[normalizeRegistry(reference.Domain(named))]
+	if !ok {
+		return nil
+	}
+	return &auth
+}
+
+// normalizeRegistry returns the host of a registry server address, such as
+// https://index.docker.io/v1/, with the aliases of Docker Hub as docker.io.
+func normalizeRegistry(server string) string {
+	server = strings.ToLower(strings.TrimSpace(server))
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubRegistry
+	}
+	return server
+}
+
+// rewriteImage returns the image with the first matching configured rewrite
+// applied, or unchanged if none matches.
+func rewriteImage(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	qualified := named.String()
+	for _, rewrite := range conf.ImageRewrites {
+		if strings.HasSuffix(rewrite.From, "*") {
+			prefix := strings.TrimSuffix(rewrite.From, "*")
+			if strings.HasPrefix(qualified, prefix) {
+				return strings.TrimSuffix(rewrite.To, "*") + qualified[len(prefix):]
+			}
+		} else if named.Name() == rewrite.From {
+			return rewrite.To + qualified[len(named.Name()):]
+		}
+	}
+	return image
+}
+
+// encodeRegistryAuth returns the auth as the docker API takes it in RegistryAuth.
+func encodeRegistryAuth(auth *types.AuthConfig) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+	content, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return b64.URLEncoding.EncodeToString(content), nil
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/rancher/go-machine-service/config"
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryAuths(t *testing.T) {
+	assert := require.New(t)
+
+	auths := cattleRegistryAuths([]v3.Registry{
+		{Resource: v3.Resource{Id: "1sp1"}, ServerAddress: "https://index.docker.io/v1/"},
+		{Resource: v3.Resource{Id: "1sp2"}, ServerAddress: "registry.example.com:5000"},
+	}, []v3.RegistryCredential{
+		{RegistryId: "1sp1", PublicValue: "hub", SecretValue: "hub-password"},
+		{RegistryId: "1sp2", PublicValue: "cattle", SecretValue: "cattle-password"},
+		{RegistryId: "1sp3", PublicValue: "orphan", SecretValue: "orphan-password"},
+	})
+	for server, auth := range templateRegistryAuths(map[string]interface{}{
+		registryCredentialsField: map[string]interface{}{
+			"Registry.Example.com:5000": map[string]interface{}{"username": "template", "password": "template-password"},
+		},
+	}) {
+		auths[server] = auth
+	}
+	assert.Len(auths, 2)
+
+	assert.Equal("hub", auths.forImage("rancher/agent").Username)
+	assert.Equal("hub", auths.forImage("docker.io/library/busybox").Username)
+	assert.Equal("template", auths.forImage("registry.example.com:5000/rancher/agent").Username)
+	assert.Nil(auths.forImage("quay.io/rancher/agent"))
+}
+
+func TestEncodeRegistryAuth(t *testing.T) {
+	assert := require.New(t)
+
+	encoded, err := encodeRegistryAuth(nil)
+	assert.Nil(err)
+	assert.Equal("", encoded)
+
+	encoded, err = encodeRegistryAuth(&types.AuthConfig{Username: "deploy", Password: "s3cr3t?", ServerAddress: "registry.example.com"})
+	assert.Nil(err)
+	content, err := b64.URLEncoding.DecodeString(encoded)
+	assert.Nil(err)
+	auth := types.AuthConfig{}
+	assert.Nil(json.Unmarshal(content, &auth))
+	assert.Equal("s3cr3t?", auth.Password)
+}
+
+func TestRewriteImage(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(rewrites []config.ImageRewrite) {
+		conf.ImageRewrites = rewrites
+	}(conf.ImageRewrites)
+	conf.ImageRewrites = []config.ImageRewrite{
+		{From: "docker.io/rancher/agent", To: "registry.internal/agents/rancher"},
+		{From: "docker.io/rancher/*", To: "registry.internal/rancher/*"},
+		{From: "docker.io/library/*", To: "registry.internal/library/*"},
+	}
+
+	assert.Equal("registry.internal/agents/rancher:v2.0", rewriteImage("rancher/agent:v2.0"))
+	assert.Equal("registry.internal/rancher/net:v0.13.5", rewriteImage("rancher/net:v0.13.5"))
+	assert.Equal("registry.internal/rancher/agent-instance:v0.3", rewriteImage("docker.io/rancher/agent-instance:v0.3"))
+	assert.Equal("registry.internal/library/busybox", rewriteImage("busybox"))
+	assert.Equal("quay.io/rancher/agent:v2.0", rewriteImage("quay.io/rancher/agent:v2.0"))
+	assert.Equal("Invalid Image", rewriteImage("Invalid Image"))
+}
@@ -12,45 +12,75 @@ import (
 
 var removeCache = cache.New(5*time.Minute, 30*time.Second)
 
-func PurgeMachine(event *events.Event, apiClient *client.RancherClient) error {
-	logger.WithFields(logrus.Fields{
-		"resourceId": event.ResourceID,
-		"eventId":    event.ID,
-	}).Info("Purging Machine")
+func PurgeMachine(event *events.Event, apiClient *client.RancherClient) (err error) {
+	log := eventLogger(event)
+	log.Info("Purging Machine")
 
 	if _, ok := removeCache.Get(event.ResourceID); ok {
-		logger.WithFields(logrus.Fields{
-			"resourceId": event.ResourceID,
-			"eventId":    event.ID,
-		}).Info("Machine already purged")
+		log.Info("Machine already purged")
 		return publishReply(newReply(event), apiClient)
 	}
 
+	// Wait for a canceled create to save the machine it started, which is then
+	// restored and removed below
+	if ops := operations.cancel(event.ResourceID, createOperation); len(ops) > 0 {
+		log.Info("Canceling provisioning of the machine")
+		for _, op := range ops {
+			<-op.done
+		}
+	}
+	for _, op := range operations.cancel(event.ResourceID, prePullOperation) {
+		<-op.done
+	}
+
 	host, hostDir, err := getHostAndHostDir(event, apiClient)
 	if err != nil || host == nil {
 		return err
 	}
+
+	if l := getLease(host); l != nil && l.Purged {
+		log.Info("Machine already purged by another instance")
+		return publishReply(newReply(event), apiClient)
+	}
+
+	// A purge is not interrupted if the lease is lost, removing the machine
+	// again is harmless
+	hostLease, err := acquireLease(host, apiClient, nil)
+	if err == errLeaseHeld {
+		log.Info("Host is leased by another instance, skipping purge")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	purged := false
+	defer func() {
+		hostLease.release(purged)
+	}()
+
+	defer func() {
+		recordOutcome(purgeTotal, host.Driver, err)
+	}()
 	err = restoreMachineDir(host, hostDir)
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(hostDir)
 
-	mExists, err := machineExists(hostDir, host.Hostname)
+	mExists, err := machines.exists(hostDir, host.Hostname)
 	if err != nil {
 		return err
 	}
 
 	if mExists {
-		if err := deleteMachine(hostDir, host); err != nil {
+		if err := machines.remove(hostDir, host, correlationID(event)); err != nil {
 			return err
 		}
 	}
 
 	removeCache.Add(event.ResourceID, true, cache.DefaultExpiration)
+	purged = true
 
-	logger.WithFields(logrus.Fields{
-		"resourceId":        event.ResourceID,
+	log.WithFields(logrus.Fields{
 		"machineExternalId": host.Uuid,
 		"machineDir":        hostDir,
 	}).Info("Machine purged")
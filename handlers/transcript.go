@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	redacted        = "[REDACTED]"
+	minSecretLength = 6
+)
+
+var (
+	// secretFlagRegEx matches the create flags whose value must not be logged
+	secretFlagRegEx = regexp.MustCompile(`(?i)(password|secret|token|key|credential)`)
+	hostIDRegEx     = regexp.MustCompile(`^[[:alnum:]._-]+$`)
+
+	errInvalidHostID = errors.New("Invalid host ID")
+)
+
+// transcript is the log of the docker-machine creates of a host. Unlike the
+// machine dir it is kept in the work dir after the provisioning, so that it
+// can be read once the host failed, and it is rotated once it reaches the
+// configured size.
+type transcript struct {
+	sync.Mutex
+	hostID   string
+	file     *os.File
+	size     int64
+	replacer *strings.Replacer
+}
+
+func transcriptDir() string {
+	return filepath.Join(getWorkDir(), "logs")
+}
+
+// transcriptFiles returns the transcript files of the host, newest first.
+func transcriptFiles(hostID string) []string {
+	files := []string{filepath.Join(transcriptDir(), hostID+".log")}
+	for i := 1; i < conf.ProvisionLogs.MaxFiles; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", files[0], i))
+	}
+	return files
+}
+
+// openTranscript opens the transcript of the host for appending. The values
+// of the secret flags of args are redacted from every line written to it.
+func openTranscript(hostID string, args []string) (*transcript, error) {
+	if !hostIDRegEx.MatchString(hostID) {
+		return nil, errInvalidHostID
+	}
+	if err := os.MkdirAll(transcriptDir(), 0740); err != nil {
+		return nil, err
+	}
+
+	t := &transcript{
+		hostID:   hostID,
+		replacer: secretsReplacer(args),
+	}
+	return t, t.open()
+}
+
+func (t *transcript) open() error {
+	file, err := os.OpenFile(transcriptFiles(t.hostID)[0], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+// secretsReplacer returns a replacer of the values of the secret flags in args,
+// given either as --flag value or --flag=value.
+func secretsReplacer(args []string) *strings.Replacer {
+	replacements := []string{}
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "--") || !secretFlagRegEx.MatchString(arg) {
+			continue
+		}
+		value := ""
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+			value = kv[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			value = args[i+1]
+		}
+		// Shorter values, such as booleans or ports, would garble the log
+		if len(value) >= minSecretLength {
+			replacements = append(replacements, value, redacted)
+		}
+	}
+	return strings.NewReplacer(replacements...)
+}
+
+// Printf writes a line, prefixed with the time and the stream it comes from,
+// such as stdout or stderr. Like Close, it may be called on a nil transcript.
+func (t *transcript) Printf(stream, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), stream,
+		t.replacer.Replace(fmt.Sprintf(format, args...)))
+	n, err := io.WriteString(t.file, line)
+	t.size += int64(n)
+	if err != nil {
+		logger.WithField("resourceId", t.hostID).Warnf("Failed to write provisioning log: %v", err)
+	}
+	if t.size >= conf.ProvisionLogs.MaxSize {
+		t.rotate()
+	}
+}
+
+func (t *transcript) rotate() {
+	t.file.Close()
+	t.file = nil
+
+	files := transcriptFiles(t.hostID)
+	os.Remove(files[len(files)-1])
+	for i := len(files) - 1; i > 0; i-- {
+		os.Rename(files[i-1], files[i])
+	}
+	if err := t.open(); err != nil {
+		logger.WithField("resourceId", t.hostID).Warnf("Failed to rotate provisioning log: %v", err)
+	}
+}
+
+func (t *transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// WriteProvisionLog writes the provisioning log of the host to w, oldest line
+// first. It returns an error satisfying os.IsNotExist if there is none.
+func WriteProvisionLog(hostID string, w io.Writer) error {
+	if !hostIDRegEx.MatchString(hostID) {
+		return errInvalidHostID
+	}
+
+	files := transcriptFiles(hostID)
+	found := false
+	for i := len(files) - 1; i >= 0; i-- {
+		f, err := os.Open(files[i])
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		found = true
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "open", Path: files[0], Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// pruneTranscripts removes the provisioning logs not written to for longer than the max age.
+func pruneTranscripts() error {
+	maxAge := conf.ProvisionLogs.MaxAge.Duration
+	if maxAge <= 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(transcriptDir(), "*.log*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > maxAge {
+			os.Remove(file)
+		}
+	}
+	return nil
+}
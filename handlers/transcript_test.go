@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-machine-service/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscript(t *testing.T) {
+	assert := require.New(t)
+
+	workDir, err := ioutil.TempDir("", "gms-transcript")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+	defer Configure(config.Default())
+	c := config.Default()
+	c.MachineWorkDir = workDir
+	c.ProvisionLogs.MaxSize = 200
+	c.ProvisionLogs.MaxFiles = 2
+	Configure(c)
+
+	err = WriteProvisionLog("1h1", ioutil.Discard)
+	assert.True(os.IsNotExist(err))
+
+	args := []string{"docker-machine", "create", "-d", "amazonec2", "--amazonec2-secret-key", "s3cr3t-value",
+		"--amazonec2-access-key=AKIAEXAMPLE", "--amazonec2-region", "us-west-2", "host1"}
+	tr, err := openTranscript("1h1", args)
+	assert.Nil(err)
+	tr.Printf("gms", "Running %s", strings.Join(args, " "))
+	tr.Printf("stdout", "Creating machine...")
+	tr.Printf("stderr", "using key s3cr3t-value")
+	assert.Nil(tr.Close())
+
+	out := &bytes.Buffer{}
+	assert.Nil(WriteProvisionLog("1h1", out))
+	log := out.String()
+	assert.NotContains(log, "s3cr3t-value")
+	assert.NotContains(log, "AKIAEXAMPLE")
+	assert.Contains(log, "us-west-2")
+	assert.Contains(log, "stdout Creating machine...")
+	assert.Contains(log, "stderr using key "+redacted)
+
+	// The first line exceeded the max size and was rotated, the oldest file is dropped
+	assert.True(strings.Index(log, "Running") < strings.Index(log, "Creating machine"))
+	files := transcriptFiles("1h1")
+	assert.Len(files, 2)
+	_, err = os.Stat(files[1])
+	assert.Nil(err)
+
+	_, err = openTranscript("../1h1", nil)
+	assert.Equal(errInvalidHostID, err)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-machine-service/handlers/providers"
+	v3 "github.com/rancher/go-rancher/v3"
+)
+
+const (
+	// userDataField is the host template value, public or secret, holding the
+	// user data, such as a cloud-init config or a script, of its hosts.
+	userDataField = "userData"
+	userDataFile  = "userdata"
+	// userDataHook is the name of the hook running the user data of drivers
+	// that do not take it at create time.
+	userDataHook = "userData"
+)
+
+// hostUserData returns the user data of the host, its template already applied.
+func hostUserData(host *v3.Host) string {
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	userData, _ := fields[userDataField].(string)
+	if strings.TrimSpace(userData) == "" {
+		return ""
+	}
+	return userData
+}
+
+// applyUserData sets the user data of the host in the driver config, so that
+// buildMachineCreateCmd passes it with the flag of the driver. The content is
+// written to the host dir if the flag expects a path. User data set in the
+// driver config itself is left untouched.
+//
+// Drivers without such a flag get the user data run over ssh once the machine
+// is created, which only works for scripts.
+func applyUserData(host *v3.Host, hostDir, driver string, log *logrus.Entry) error {
+	userData := hostUserData(host)
+	if userData == "" {
+		return nil
+	}
+
+	mapping := providers.GetProviderHandler(driver).UserData()
+	if !mapping.Supported() {
+		if !strings.HasPrefix(userData, "#!") {
+			return fmt.Errorf("Driver %s does not support user data, only scripts can be run over ssh instead", driver)
+		}
+		log.Infof("Driver %s does not support user data, running it over ssh once created", driver)
+		return nil
+	}
+
+	fields, _ := host.Data["fields"].(map[string]interface{})
+	driverConfig, ok := fields[driver+"Config"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%vConfig does not exist on Machine %v", driver, host.Id)
+	}
+	if value, _ := driverConfig[mapping.Field].(string); value != "" {
+		log.Infof("Driver config sets %s, ignoring template user data", mapping.Field)
+		return nil
+	}
+
+	value := userData
+	if mapping.Path {
+		value = filepath.Join(hostDir, userDataFile)
+		if err := ioutil.WriteFile(value, []byte(userData), 0600); err != nil {
+			return err
+		}
+	}
+	driverConfig[mapping.Field] = value
+	return nil
+}
+
+// userDataHooks returns the hook running the user data of the host if its
+// driver does not take it at create time.
+func userDataHooks(host *v3.Host) []hook {
+	userData := hostUserData(host)
+	if userData == "" || providers.GetProviderHandler(host.Driver).UserData().Supported() {
+		return nil
+	}
+	return []hook{{name: userDataHook, script: userData}}
+}
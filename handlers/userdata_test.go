@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v3 "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyUserData(t *testing.T) {
+	assert := require.New(t)
+
+	hostDir, err := ioutil.TempDir("", "gms-userdata")
+	assert.Nil(err)
+	defer os.RemoveAll(hostDir)
+
+	userData := "#cloud-config\npackages:\n  - nfs-common\n"
+	host := &v3.Host{Hostname: "host1", Driver: "amazonec2"}
+	host.Data = map[string]interface{}{
+		"fields": map[string]interface{}{
+			userDataField:     userData,
+			"amazonec2Config": map[string]interface{}{"region": "us-west-1"},
+		},
+	}
+
+	assert.Nil(applyUserData(host, hostDir, "amazonec2", logger.WithField("test", "TestApplyUserData")))
+	path := filepath.Join(hostDir, userDataFile)
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(userData, string(content))
+
+	cmd, err := buildMachineCreateCmd(host, "amazonec2")
+	assert.Nil(err)
+	assert.Contains(cmd, "--amazonec2-userdata")
+	assert.Contains(cmd, path)
+	assert.Empty(userDataHooks(host))
+}
+
+func TestUserDataOverSSH(t *testing.T) {
+	assert := require.New(t)
+
+	host := &v3.Host{Hostname: "host1", Driver: "rackspace"}
+	host.Data = map[string]interface{}{
+		"fields": map[string]interface{}{
+			userDataField:     "#cloud-config\nruncmd:\n  - touch /tmp/done\n",
+			"rackspaceConfig": map[string]interface{}{},
+		},
+	}
+	log := logger.WithField("test", "TestUserDataOverSSH")
+
+	// Only scripts can be run over ssh
+	assert.NotNil(applyUserData(host, "", "rackspace", log))
+
+	script := "#!/bin/bash\ntouch /tmp/done\n"
+	host.Data["fields"].(map[string]interface{})[userDataField] = script
+	host.Labels = map[string]interface{}{hookLabelPrefix + "ca": "update-ca-certificates"}
+	assert.Nil(applyUserData(host, "", "rackspace", log))
+	assert.Equal([]hook{
+		{name: userDataHook, script: script},
+		{name: "ca", script: "update-ca-certificates"},
+	}, postCreateHooks(host))
+}
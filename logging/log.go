@@ -1,6 +1,15 @@
 package logging
 
-import "github.com/Sirupsen/logrus"
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// CorrelationIDField is the log field, and event data key, of the ID that ties
+// together everything done while handling one event.
+const CorrelationIDField = "correlationId"
 
 var log = logrus.WithFields(logrus.Fields{
 	"service": "gms",
@@ -9,3 +18,9 @@ var log = logrus.WithFields(logrus.Fields{
 func Logger() *logrus.Entry {
 	return log
 }
+
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -4,12 +4,22 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/event-subscriber/locks"
+	"github.com/rancher/go-machine-service/config"
 	"github.com/rancher/go-machine-service/dynamic"
 	"github.com/rancher/go-machine-service/handlers"
 	"github.com/rancher/go-machine-service/logging"
+	"github.com/rancher/go-machine-service/replay"
+	"github.com/rancher/go-machine-service/server"
+	"github.com/rancher/go-machine-service/tracing"
+	client "github.com/rancher/go-rancher/v3"
 )
 
 var (
@@ -18,67 +28,73 @@ var (
 
 var logger = logging.Logger()
 
+// middlewares wrap every event handler, the first one being the outermost.
+var middlewares = []handlers.Middleware{handlers.Track, handlers.Correlate, handlers.Trace, handlers.Time, handlers.Recover}
+
 func main() {
-	processCmdLineFlags()
-	logrus.SetLevel(logrus.DebugLevel)
+	if replay.IsDockerMachine(os.Args) {
+		os.Exit(replay.DockerMachine(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay.Main(os.Args[2:], eventHandlers(newRouters())))
+	}
+
+	conf := processCmdLineFlags()
+	level, _ := logrus.ParseLevel(conf.LogLevel)
+	logrus.SetLevel(level)
 
 	logger.WithField("gitcommit", GITCOMMIT).Info("Starting go-machine-service...")
 
-	apiURL := os.Getenv("CATTLE_URL")
-	accessKey := os.Getenv("CATTLE_ACCESS_KEY")
-	secretKey := os.Getenv("CATTLE_SECRET_KEY")
+	handlers.Configure(conf)
+	dynamic.Configure(conf)
+	if err := tracing.Configure(conf.Tracing); err != nil {
+		logger.Fatalf("Error configuring tracing: %v", err)
+	}
+
+	if err := handlers.RecoverCheckpoints(); err != nil {
+		logger.Fatalf("Error recovering checkpoints: %v", err)
+	}
+	apiClient, err := client.NewRancherClient(&client.ClientOpts{
+		Url:       conf.CattleURL,
+		AccessKey: conf.CattleAccessKey,
+		SecretKey: conf.CattleSecretKey,
+		Timeout:   time.Second * 60,
+	})
+	if err != nil {
+		logger.Fatalf("Error creating api client: %v", err)
+	}
 
 	ready := make(chan bool, 2)
-	done := make(chan error)
+	done := make(chan error, 5)
 
-	go func() {
-		eventHandlers := map[string]events.EventHandler{
-			"machinedriver.reactivate": handlers.ActivateDriver,
-			"machinedriver.activate":   handlers.ActivateDriver,
-			"machinedriver.update":     handlers.ActivateDriver,
-			"machinedriver.error":      handlers.ErrorDriver,
-			"machinedriver.deactivate": handlers.DeactivateDriver,
-			"machinedriver.remove":     handlers.RemoveDriver,
-			"ping":                     handlers.PingNoOp,
-		}
-
-		router, err := events.NewEventRouter("machine-service", 2000, apiURL, accessKey, secretKey,
-			nil, eventHandlers, "machineDriver", 250, events.DefaultPingConfig)
-		if err == nil {
-			err = router.Start(ready)
-		}
-		done <- err
-	}()
+	routers := newRouters()
 
+	statusServer := &server.Server{
+		Routers: func() []server.RouterStatus {
+			statuses := []server.RouterStatus{}
+			for _, r := range routers {
+				statuses = append(statuses, r.status())
+			}
+			return statuses
+		},
+		Drivers:      dynamic.DriverStatuses,
+		Running:      handlers.Running,
+		ProvisionLog: handlers.WriteProvisionLog,
+	}
 	go func() {
-		eventHandlers := map[string]events.EventHandler{
-			"host.provision": handlers.CreateMachineAndActivateMachine,
-			"host.remove":    handlers.PurgeMachine,
-			"ping":           handlers.PingNoOp,
-		}
-
-		router, err := events.NewEventRouter("machine-service", 2000, apiURL, accessKey, secretKey,
-			nil, eventHandlers, "host", 250, events.DefaultPingConfig)
-		if err == nil {
-			err = router.Start(ready)
-		}
-		done <- err
+		done <- server.ListenAndServe(conf.ProbeAddress, statusServer.ProbeHandler())
 	}()
-
 	go func() {
-		// Can not remove this as nothing will delete the handler entries
-		eventHandlers := map[string]events.EventHandler{
-			"ping": handlers.PingNoOp,
-		}
-
-		router, err := events.NewEventRouter("machine-service", 2000, apiURL, accessKey, secretKey,
-			nil, eventHandlers, "agent", 5, events.DefaultPingConfig)
-		if err == nil {
-			err = router.Start(ready)
-		}
-		done <- err
+		done <- server.ListenAndServe(conf.ListenAddress, statusServer.Handler())
 	}()
 
+	for _, r := range routers {
+		go func(r *router) {
+			done <- r.start(conf, ready)
+		}(r)
+	}
+
+	stopReconciler := make(chan struct{})
 	go func() {
 		logger.Infof("Waiting for handler registration (1/2)")
 		<-ready
@@ -90,9 +106,24 @@ func main() {
 		if err := dynamic.DownloadAllDrivers(); err != nil {
 			logger.Fatalf("Error updating drivers: %v", err)
 		}
+		statusServer.SetReady(true)
+		handlers.NewReconciler(apiClient).Run(stopReconciler)
 	}()
 
-	err := <-done
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err = <-done:
+	case sig := <-signals:
+		logger.Infof("Received %v, shutting down", sig)
+	}
+
+	statusServer.SetReady(false)
+	close(stopReconciler)
+	shutdown(routers, conf.DrainTimeout.Duration)
+	tracing.Shutdown()
+
 	if err == nil {
 		logger.Infof("Exiting go-machine-service")
 	} else {
@@ -100,12 +131,225 @@ func main() {
 	}
 }
 
-func processCmdLineFlags() {
-	// Define command line flags
-	version := flag.Bool("v", false, "read the version of the go-machine-service")
-	flag.Parse()
-	if *version {
+func newRouters() []*router {
+	return []*router{
+		{
+			resourceName: "machineDriver",
+			workerCount:  250,
+			eventHandlers: map[string]events.EventHandler{
+				"machinedriver.reactivate": handlers.ActivateDriver,
+				"machinedriver.activate":   handlers.ActivateDriver,
+				"machinedriver.update":     handlers.ActivateDriver,
+				"machinedriver.error":      handlers.ErrorDriver,
+				"machinedriver.deactivate": handlers.DeactivateDriver,
+				"machinedriver.remove":     handlers.RemoveDriver,
+				"ping":                     handlers.PingNoOp,
+			},
+		},
+		{
+			resourceName: "host",
+			workerCount:  250,
+			eventHandlers: map[string]events.EventHandler{
+				"host.provision": handlers.CreateMachineAndActivateMachine,
+				"ping":           handlers.PingNoOp,
+			},
+			// A remove must reach the host while it is provisioning, to cancel
+			// the provisioning, which holds the lock of the host
+			unlockedHandlers: map[string]events.EventHandler{
+				"host.remove": handlers.PurgeMachine,
+			},
+		},
+		{
+			// Can not remove this as nothing will delete the handler entries
+			resourceName: "agent",
+			workerCount:  5,
+			eventHandlers: map[string]events.EventHandler{
+				"ping": handlers.PingNoOp,
+			},
+		},
+	}
+}
+
+// eventHandlers returns the handlers of all routers, wrapped as they are when
+// the routers start.
+func eventHandlers(routers []*router) map[string]events.EventHandler {
+	all := map[string]events.EventHandler{}
+	for _, r := range routers {
+		for name, handler := range handlers.Wrap(r.eventHandlers, middlewares...) {
+			all[name] = handler
+		}
+		for name, handler := range handlers.Wrap(r.unlockedHandlers, middlewares...) {
+			all[name] = handler
+		}
+	}
+	return all
+}
+
+// shutdown stops all routers from taking new events and waits up to drainTimeout
+// for running handlers. Any docker-machine command still running after that is
+// checkpointed so that the next start can clean it up.
+func shutdown(routers []*router, drainTimeout time.Duration) {
+	for _, r := range routers {
+		r.stop()
+	}
+
+	logger.Infof("Waiting up to %v for running handlers", drainTimeout)
+	if handlers.Drain(drainTimeout) {
+		return
+	}
+
+	logger.Warn("Handlers still running after drain timeout, checkpointing docker-machine commands")
+	if err := handlers.CheckpointRunningCommands(); err != nil {
+		logger.Errorf("Error checkpointing docker-machine commands: %v", err)
+	}
+}
+
+const handlerName = "machine-service"
+
+type router struct {
+	sync.Mutex
+	resourceName  string
+	workerCount   int
+	eventHandlers map[string]events.EventHandler
+	// unlockedHandlers are subscribed to on a connection of their own, whose
+	// events don't take the lock of their resource. The event router drops the
+	// events of a locked resource, held by the handler of another event of the
+	// resource.
+	unlockedHandlers map[string]events.EventHandler
+
+	router       *events.EventRouter
+	unlockedPool *stoppablePool
+	subscribed   bool
+	stopped      bool
+}
+
+func (r *router) start(conf *config.Config, ready chan<- bool) error {
+	eventHandlers := handlers.Wrap(r.eventHandlers, middlewares...)
+
+	router, err := events.NewEventRouter(handlerName, 2000, conf.CattleURL, conf.CattleAccessKey, conf.CattleSecretKey,
+		nil, eventHandlers, r.resourceName, r.workerCount, events.DefaultPingConfig)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+	if len(r.unlockedHandlers) > 0 {
+		// Unlike Start, RunWithWorkerPool subscribes to the event names as
+		// they are, without the suffix of the handler
+		unlockedHandlers := map[string]events.EventHandler{}
+		for name, handler := range handlers.Wrap(r.unlockedHandlers, middlewares...) {
+			unlockedHandlers[name+";handler="+handlerName] = handler
+		}
+		unlockedRouter, err := events.NewEventRouter(handlerName, 2000, conf.CattleURL, conf.CattleAccessKey, conf.CattleSecretKey,
+			nil, unlockedHandlers, r.resourceName, r.workerCount, events.DefaultPingConfig)
+		if err != nil {
+			return err
+		}
+		// Events of the same name and resource still don't run at once
+		pool := &stoppablePool{pool: events.SkippingWorkerPool(r.workerCount, eventNameLocker)}
+		r.Lock()
+		r.unlockedPool = pool
+		r.Unlock()
+		go func() {
+			errs <- unlockedRouter.RunWithWorkerPool(pool)
+		}()
+	}
+
+	r.Lock()
+	r.router = router
+	r.Unlock()
+
+	subscribed := make(chan bool, 1)
+	go func() {
+		if <-subscribed {
+			r.setSubscribed()
+			ready <- true
+		}
+	}()
+
+	go func() {
+		err := router.Start(subscribed)
+		close(subscribed)
+		errs <- err
+	}()
+	return <-errs
+}
+
+// eventNameLocker locks the resource of the event for the events of its name only.
+func eventNameLocker(event *events.Event) locks.Locker {
+	if event.ResourceID == "" {
+		return locks.NopLocker()
+	}
+	return locks.KeyLocker(fmt.Sprintf("%s:%s:%s", event.Name, event.ResourceType, event.ResourceID))
+}
+
+// stoppablePool drops the events it is given once stopped. The connection of a
+// router run with a worker pool can't be closed safely, as the router doesn't
+// tell when it is established.
+type stoppablePool struct {
+	sync.Mutex
+	pool    events.WorkerPool
+	stopped bool
+}
+
+func (p *stoppablePool) HandleWork(event *events.Event, eventHandlers map[string]events.EventHandler, apiClient *client.RancherClient) {
+	p.Lock()
+	stopped := p.stopped
+	p.Unlock()
+	if stopped {
+		logger.WithField("resourceId", event.ResourceID).Infof("Shutting down, dropping event %s", event.Name)
+		return
+	}
+	p.pool.HandleWork(event, eventHandlers, apiClient)
+}
+
+func (p *stoppablePool) stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+}
+
+func (r *router) setSubscribed() {
+	r.Lock()
+	defer r.Unlock()
+	r.subscribed = true
+	// Stop was requested before the subscription was established
+	if r.stopped {
+		r.router.Stop()
+	}
+}
+
+func (r *router) status() server.RouterStatus {
+	r.Lock()
+	defer r.Unlock()
+	return server.RouterStatus{
+		ResourceName: r.resourceName,
+		Subscribed:   r.subscribed && !r.stopped,
+	}
+}
+
+func (r *router) stop() {
+	r.Lock()
+	defer r.Unlock()
+	if r.subscribed && !r.stopped {
+		r.router.Stop()
+	}
+	if r.unlockedPool != nil {
+		r.unlockedPool.stop()
+	}
+	r.stopped = true
+}
+
+func processCmdLineFlags() *config.Config {
+	conf, err := config.Load(os.Args[1:], os.Getenv)
+	if conf != nil && conf.ShowVersion {
 		fmt.Printf("go-machine-service\t gitcommit=%s\n", GITCOMMIT)
 		os.Exit(0)
 	}
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		logger.Fatalf("Invalid configuration: %v", err)
+	}
+	return conf
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
+	"github.com/rancher/go-machine-service/handlers"
+	client "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// cattle serves the API root and the event subscriptions, sending each
+// subscription the events of the names it subscribed to once their channel is
+// closed.
+type cattle struct {
+	*httptest.Server
+	events map[string]<-chan struct{}
+}
+
+func newCattle(events map[string]<-chan struct{}) *cattle {
+	c := &cattle{events: events}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+	return c
+}
+
+func (c *cattle) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/v3/subscribe":
+		c.subscribe(rw, req)
+	case "/v3/schemas":
+		rw.Write([]byte(`{"type": "collection", "data": []}`))
+	default:
+		rw.Header().Set("X-API-Schemas", c.URL+"/v3/schemas")
+		rw.Write([]byte(`{}`))
+	}
+}
+
+func (c *cattle) subscribe(rw http.ResponseWriter, req *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for _, name := range req.URL.Query()["eventNames"] {
+		send, ok := c.events[name]
+		if !ok {
+			continue
+		}
+		go func(name string) {
+			<-send
+			conn.WriteJSON(&events.Event{
+				ID:           name,
+				Name:         name,
+				ResourceID:   "1h1",
+				ResourceType: "host",
+			})
+		}(name)
+	}
+	// Read to answer the pings of the router
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func TestRouterRemoveWhileProvisioning(t *testing.T) {
+	assert := require.New(t)
+
+	now := make(chan struct{})
+	close(now)
+	provisioning := make(chan struct{})
+	removed := make(chan struct{})
+	canceled := make(chan bool, 1)
+
+	c := newCattle(map[string]<-chan struct{}{
+		"host.provision;handler=machine-service": now,
+		"host.remove;handler=machine-service":    provisioning,
+	})
+	defer c.Close()
+
+	r := &router{
+		resourceName: "host",
+		workerCount:  5,
+		eventHandlers: map[string]events.EventHandler{
+			"host.provision": func(event *events.Event, apiClient *client.RancherClient) error {
+				close(provisioning)
+				select {
+				case <-removed:
+					canceled <- true
+				case <-time.After(5 * time.Second):
+					canceled <- false
+				}
+				return nil
+			},
+			"ping": handlers.PingNoOp,
+		},
+		unlockedHandlers: map[string]events.EventHandler{
+			"host.remove": func(event *events.Event, apiClient *client.RancherClient) error {
+				close(removed)
+				return nil
+			},
+		},
+	}
+	ready := make(chan bool, 1)
+	go r.start(&config.Config{CattleURL: c.URL + "/v3"}, ready)
+	defer r.stop()
+
+	assert.True(<-canceled, "the remove should run while the host is provisioning")
+}
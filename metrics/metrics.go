@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds metrics and renders them in the Prometheus text exposition format.
+type Registry struct {
+	sync.Mutex
+	vecs []*vec
+}
+
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(v *vec) {
+	r.Lock()
+	defer r.Unlock()
+	for _, existing := range r.vecs {
+		if existing.name == v.name {
+			panic("metric already registered: " + v.name)
+		}
+	}
+	r.vecs = append(r.vecs, v)
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	vecs := append([]*vec{}, r.vecs...)
+	r.Unlock()
+
+	sort.Sort(byName(vecs))
+	for _, v := range vecs {
+		if err := v.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byName []*vec
+
+func (v byName) Len() int           { return len(v) }
+func (v byName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byName) Less(i, j int) bool { return v[i].name < v[j].name }
+
+// Handler serves the metrics of the default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultRegistry.Write(rw)
+	})
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+type vec struct {
+	sync.Mutex
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+func newVec(name, help, metricType string, buckets []float64, labels []string) *vec {
+	v := &vec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	DefaultRegistry.register(v)
+	return v
+}
+
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(v.buckets)),
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) write(w io.Writer) error {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.metricType); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.metricType != "histogram" {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(s.labelValues, ""), formatFloat(s.value)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var cumulative uint64
+		for i, bucket := range v.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(s.labelValues, formatFloat(bucket)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			v.name, v.labelString(s.labelValues, "+Inf"), s.count,
+			v.name, v.labelString(s.labelValues, ""), formatFloat(s.sum),
+			v.name, v.labelString(s.labelValues, ""), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelValueEscaper escapes label values as the text exposition format does,
+// which only escapes backslashes, double quotes and newlines.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (v *vec) labelString(labelValues []string, le string) string {
+	pairs := []string{}
+	for i, label := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueEscaper.Replace(labelValues[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type Counter struct {
+	vec *vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{vec: newVec(name, help, "counter", nil, labels)}
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.vec.Lock()
+	defer c.vec.Unlock()
+	c.vec.get(labelValues).value += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type Gauge struct {
+	vec *vec
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{vec: newVec(name, help, "gauge", nil, labels)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.vec.Lock()
+	defer g.vec.Unlock()
+	g.vec.get(labelValues).value = value
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.vec.Lock()
+	defer g.vec.Unlock()
+	g.vec.get(labelValues).value += value
+}
+
+type Histogram struct {
+	vec *vec
+}
+
+// NewHistogram creates a histogram with the given upper bounds, which must be sorted.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{vec: newVec(name, help, "histogram", buckets, labels)}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.vec.Lock()
+	defer h.vec.Unlock()
+	s := h.vec.get(labelValues)
+	for i, bucket := range h.vec.buckets {
+		if value <= bucket {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Since observes the seconds elapsed since start.
+func (h *Histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
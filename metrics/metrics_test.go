@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	assert := require.New(t)
+
+	c := NewCounter("test_counter_total", "A test counter", "driver", "result")
+	c.Inc("amazonec2", "success")
+	c.Inc("amazonec2", "success")
+	c.Add(3, "packet", "error")
+
+	out := &bytes.Buffer{}
+	assert.Nil(c.vec.write(out))
+	assert.Equal(strings.Join([]string{
+		"# HELP test_counter_total A test counter",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{driver="amazonec2",result="success"} 2`,
+		`test_counter_total{driver="packet",result="error"} 3`,
+		"",
+	}, "\n"), out.String())
+}
+
+func TestHistogram(t *testing.T) {
+	assert := require.New(t)
+
+	h := NewHistogram("test_duration_seconds", "A test histogram", []float64{1, 5}, "phase")
+	h.Observe(0.5, "create")
+	h.Observe(3, "create")
+	h.Observe(10, "create")
+
+	out := &bytes.Buffer{}
+	assert.Nil(h.vec.write(out))
+	assert.Equal(strings.Join([]string{
+		"# HELP test_duration_seconds A test histogram",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{phase="create",le="1"} 1`,
+		`test_duration_seconds_bucket{phase="create",le="5"} 2`,
+		`test_duration_seconds_bucket{phase="create",le="+Inf"} 3`,
+		`test_duration_seconds_sum{phase="create"} 13.5`,
+		`test_duration_seconds_count{phase="create"} 3`,
+		"",
+	}, "\n"), out.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	assert := require.New(t)
+
+	c := NewCounter("test_escaping_total", "A test counter", "error")
+	c.Inc("café \"quoted\" C:\\path\nnext\x01")
+
+	out := &bytes.Buffer{}
+	assert.Nil(c.vec.write(out))
+	assert.Contains(out.String(), `test_escaping_total{error="café \"quoted\" C:\\path\nnext`+"\x01"+`"} 1`)
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	c := NewCounter("test_mismatch_total", "A test counter", "driver")
+	require.Panics(t, func() { c.Inc() })
+}
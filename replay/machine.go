@@ -0,0 +1,38 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	urlEnv            = "GMS_REPLAY_URL"
+	dockerMachineName = "docker-machine"
+)
+
+// IsDockerMachine returns whether the process was started as the docker-machine
+// stand-in of a replay.
+func IsDockerMachine(args []string) bool {
+	return len(args) > 0 && filepath.Base(args[0]) == dockerMachineName && os.Getenv(urlEnv) != ""
+}
+
+// DockerMachine records its invocation with the replay and exits without
+// output, as if docker-machine had succeeded.
+func DockerMachine(args []string) int {
+	content, err := json.Marshal(Record{Kind: KindDockerMachine, Args: args})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := http.Post(os.Getenv(urlEnv)+machinePath, "application/json", bytes.NewReader(content))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	return 0
+}
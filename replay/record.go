@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+const (
+	KindAPI           = "api"
+	KindPublish       = "publish"
+	KindDockerMachine = "docker-machine"
+	KindResult        = "result"
+)
+
+// Record is something the handler did while being replayed.
+type Record struct {
+	Kind   string          `json:"kind"`
+	Method string          `json:"method,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Args   []string        `json:"args,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Recorder writes records as JSON lines, in the order they happen.
+type Recorder struct {
+	sync.Mutex
+	encoder *json.Encoder
+	records []Record
+}
+
+func NewRecorder(out io.Writer) *Recorder {
+	return &Recorder{
+		encoder: json.NewEncoder(out),
+	}
+}
+
+func (r *Recorder) Add(record Record) {
+	r.Lock()
+	defer r.Unlock()
+	r.records = append(r.records, record)
+	r.encoder.Encode(record)
+}
+
+// Records returns the records added so far.
+func (r *Recorder) Records() []Record {
+	r.Lock()
+	defer r.Unlock()
+	return append([]Record{}, r.records...)
+}
@@ -0,0 +1,166 @@
+package replay
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/config"
+	"github.com/rancher/go-machine-service/dynamic"
+	"github.com/rancher/go-machine-service/handlers"
+	client "github.com/rancher/go-rancher/v3"
+)
+
+const usage = `Usage: go-machine-service replay -event EVENT -snapshot SNAPSHOT [options]
+
+Runs the handler of a recorded event against an in-process stub of the Cattle
+API serving the snapshot, and prints every API call, publish and docker-machine
+invocation the handler makes as JSON lines.
+
+The snapshot is a JSON object of resources by type, such as
+{"host": [...], "hostTemplate": [...], "cluster": [...], "machineDriver": [...]}.
+
+Unless -docker-machine is given, docker-machine is not run: its invocations are
+recorded and succeed without output.
+
+`
+
+// Main runs the replay command with the arguments following "replay" and
+// returns the exit code, which is 0 only if the handler succeeded.
+func Main(args []string, eventHandlers map[string]events.EventHandler) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	eventFile := fs.String("event", "", "JSON file of the recorded event")
+	snapshotFile := fs.String("snapshot", "", "JSON file of the resources referenced by the event")
+	outputFile := fs.String("output", "", "file to write the records to, defaults to stdout")
+	dockerMachine := fs.String("docker-machine", "", "run this docker-machine binary instead of recording its invocations")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *eventFile == "" || *snapshotFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := Run(*eventFile, *snapshotFile, *dockerMachine, eventHandlers, NewRecorder(out)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Run replays the event against the snapshot, adding what the handler does to
+// the recorder. It returns the error of the handler.
+func Run(eventFile, snapshotFile, dockerMachine string, eventHandlers map[string]events.EventHandler, recorder *Recorder) error {
+	event := &events.Event{}
+	if err := readJSON(eventFile, event); err != nil {
+		return err
+	}
+	snapshot := Snapshot{}
+	if err := readJSON(snapshotFile, &snapshot); err != nil {
+		return err
+	}
+
+	handler, ok := eventHandlers[event.Name]
+	if !ok {
+		return errors.Errorf("No handler for event %s", event.Name)
+	}
+
+	workDir, err := ioutil.TempDir("", "gms-replay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	stub := NewStub(snapshot, recorder)
+	defer stub.Close()
+
+	if dockerMachine == "" {
+		if dockerMachine, err = standIn(workDir, stub); err != nil {
+			return err
+		}
+	}
+
+	// Keep drivers and machine dirs away from those of a running service
+	conf := config.Default()
+	conf.CattleURL = stub.URL()
+	conf.CattleHome = workDir
+	conf.BinDir = filepath.Join(workDir, "bin")
+	conf.DockerMachine = dockerMachine
+	if err := os.MkdirAll(conf.BinDir, 0755); err != nil {
+		return err
+	}
+	os.Setenv("PATH", conf.BinDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	handlers.Configure(conf)
+	dynamic.Configure(conf)
+
+	apiClient, err := client.NewRancherClient(&client.ClientOpts{
+		Url: conf.CattleURL,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Connecting to the stub Cattle API")
+	}
+
+	err = handler(event, apiClient)
+	if err != nil {
+		// As the event router does
+		apiClient.Publish.Create(&client.Publish{
+			Name:                 event.ReplyTo,
+			PreviousIds:          []string{event.ID},
+			Transitioning:        "error",
+			TransitioningMessage: err.Error(),
+		})
+		recorder.Add(Record{Kind: KindResult, Error: err.Error()})
+		return err
+	}
+	recorder.Add(Record{Kind: KindResult})
+	return nil
+}
+
+// standIn links the running binary as docker-machine, so that its invocations
+// are recorded by the stub.
+func standIn(workDir string, stub *Stub) (string, error) {
+	self, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	self, err = filepath.Abs(self)
+	if err != nil {
+		return "", err
+	}
+	link := filepath.Join(workDir, dockerMachineName)
+	if err := os.Symlink(self, link); err != nil {
+		return "", err
+	}
+	os.Setenv(urlEnv, stub.server.URL)
+	return link, nil
+}
+
+func readJSON(file string, obj interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(json.Unmarshal(content, obj), "Reading %s", file)
+}
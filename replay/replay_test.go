@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/event-subscriber/events"
+	"github.com/rancher/go-machine-service/handlers"
+	client "github.com/rancher/go-rancher/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func TestReplayPurge(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "gms-replay-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	eventFile := writeFile(t, dir, "event.json", `{
+		"name": "host.remove",
+		"id": "event-1",
+		"replyTo": "reply.1",
+		"resourceId": "1h1",
+		"resourceType": "host"
+	}`)
+	snapshotFile := writeFile(t, dir, "snapshot.json", `{
+		"host": [{"id": "1h1", "uuid": "uuid-1", "hostname": "host-1", "driver": "digitalocean", "state": "removing"}]
+	}`)
+
+	out := &bytes.Buffer{}
+	recorder := NewRecorder(out)
+	err = Run(eventFile, snapshotFile, "true", map[string]events.EventHandler{
+		"host.remove": handlers.PurgeMachine,
+	}, recorder)
+	assert.Nil(err)
+
+	kinds := map[string]int{}
+	for _, record := range recorder.Records() {
+		kinds[record.Kind]++
+	}
+	assert.Equal(1, kinds[KindPublish])
+	assert.Equal(1, kinds[KindResult])
+	assert.True(kinds[KindAPI] > 0)
+	assert.Contains(out.String(), `"path":"/v3/hosts/1h1"`)
+}
+
+func TestReplayErrorReply(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "gms-replay-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	eventFile := writeFile(t, dir, "event.json", `{"name": "host.provision", "id": "event-1", "resourceId": "1h1"}`)
+	snapshotFile := writeFile(t, dir, "snapshot.json", `{}`)
+
+	recorder := NewRecorder(ioutil.Discard)
+	err = Run(eventFile, snapshotFile, "true", map[string]events.EventHandler{
+		"host.provision": func(event *events.Event, apiClient *client.RancherClient) error {
+			return errors.New("Host not found")
+		},
+	}, recorder)
+	assert.NotNil(err)
+
+	records := recorder.Records()
+	assert.Equal(KindPublish, records[len(records)-2].Kind)
+	assert.Contains(string(records[len(records)-2].Body), `"transitioning":"error"`)
+	assert.Equal(KindResult, records[len(records)-1].Kind)
+}
+
+func TestReplayRegistries(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "gms-replay-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	eventFile := writeFile(t, dir, "event.json", `{"name": "host.provision", "id": "event-1", "resourceId": "1h1"}`)
+	snapshotFile := writeFile(t, dir, "snapshot.json", `{
+		"registry": [{"id": "1sp1", "clusterId": "1c1", "state": "active", "serverAddress": "registry.example.com"}],
+		"registryCredential": [
+			{"id": "1c2", "clusterId": "1c1", "state": "active", "registryId": "1sp1", "publicValue": "deploy", "secretValue": "secret"},
+			{"id": "1c3", "clusterId": "1c2", "state": "active", "registryId": "1sp1", "publicValue": "other"}
+		]
+	}`)
+
+	var registries []client.Registry
+	var credentials []client.RegistryCredential
+	recorder := NewRecorder(ioutil.Discard)
+	err = Run(eventFile, snapshotFile, "true", map[string]events.EventHandler{
+		"host.provision": func(event *events.Event, apiClient *client.RancherClient) error {
+			filters := map[string]interface{}{"clusterId": "1c1", "removed_null": true, "state": "active"}
+			registryCollection, err := apiClient.Registry.List(&client.ListOpts{Filters: filters})
+			if err != nil {
+				return err
+			}
+			credentialCollection, err := apiClient.RegistryCredential.List(&client.ListOpts{Filters: filters})
+			if err != nil {
+				return err
+			}
+			registries, credentials = registryCollection.Data, credentialCollection.Data
+			return nil
+		},
+	}, recorder)
+	assert.Nil(err)
+
+	assert.Len(registries, 1)
+	assert.Equal("registry.example.com", registries[0].ServerAddress)
+	assert.Len(credentials, 1)
+	assert.Equal("deploy", credentials[0].PublicValue)
+	assert.Equal("secret", credentials[0].SecretValue)
+}
+
+func TestMatches(t *testing.T) {
+	assert := require.New(t)
+
+	resource := map[string]interface{}{"state": "active", "name": "amazonec2"}
+	assert.True(matches(resource, map[string][]string{"state": {"active"}}))
+	assert.False(matches(resource, map[string][]string{"state": {"inactive"}}))
+	assert.False(matches(resource, map[string][]string{"state_ne": {"active"}}))
+	assert.True(matches(resource, map[string][]string{"removed_null": {"true"}}))
+	assert.False(matches(resource, map[string][]string{"name_null": {"true"}}))
+}
+
+func TestMergeData(t *testing.T) {
+	assert := require.New(t)
+
+	resource := map[string]interface{}{"data": map[string]interface{}{"fields": "kept", "machineServiceLease": "old"}}
+	mergeData(resource, map[string]interface{}{"data": map[string]interface{}{"machineServiceLease": "new"}})
+	assert.Equal(map[string]interface{}{"fields": "kept", "machineServiceLease": "new"}, resource["data"])
+}
@@ -0,0 +1,318 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/rancher/go-rancher/v3"
+)
+
+const (
+	apiPath     = "/v3"
+	machinePath = "/replay/docker-machine"
+)
+
+// schemas are the resource types the handlers use, by plural name.
+var schemas = map[string]string{
+	"accounts":            "account",
+	"clusters":            "cluster",
+	"dynamicschemas":      "dynamicSchema",
+	"hosts":               "host",
+	"hosttemplates":       "hostTemplate",
+	"machinedrivers":      "machineDriver",
+	"publishes":           "publish",
+	"registries":          "registry",
+	"registrycredentials": "registryCredential",
+	"services":            "service",
+	"settings":            "setting",
+}
+
+var actions = []string{"activate", "deactivate", "error", "provision", "reactivate", "remove", "update"}
+
+// Snapshot holds the resources served by the stub, by schema type such as
+// "host" or "machineDriver".
+type Snapshot map[string][]map[string]interface{}
+
+// Stub is an in-process Cattle API serving a snapshot of resources. Every
+// request it receives is recorded.
+type Stub struct {
+	sync.Mutex
+	server    *httptest.Server
+	recorder  *Recorder
+	resources map[string]map[string]map[string]interface{}
+	nextID    int
+}
+
+func NewStub(snapshot Snapshot, recorder *Recorder) *Stub {
+	s := &Stub{
+		recorder:  recorder,
+		resources: map[string]map[string]map[string]interface{}{},
+	}
+	for _, schemaType := range schemas {
+		s.resources[schemaType] = map[string]map[string]interface{}{}
+	}
+	for schemaType, resources := range snapshot {
+		if s.resources[schemaType] == nil {
+			s.resources[schemaType] = map[string]map[string]interface{}{}
+		}
+		for _, resource := range resources {
+			id, _ := resource["id"].(string)
+			if id == "" {
+				id = s.newID()
+				resource["id"] = id
+			}
+			s.resources[schemaType][id] = resource
+		}
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL is the URL of the Cattle API.
+func (s *Stub) URL() string {
+	return s.server.URL + apiPath
+}
+
+func (s *Stub) Close() {
+	s.server.Close()
+}
+
+func (s *Stub) newID() string {
+	s.nextID++
+	return fmt.Sprintf("1r%d", s.nextID)
+}
+
+func (s *Stub) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.URL.Path == machinePath {
+		record := Record{}
+		if err := json.Unmarshal(body, &record); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.recorder.Add(record)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, apiPath)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "" || path == "/":
+		rw.Header().Set("X-API-Schemas", s.URL()+"/schemas")
+		s.write(rw, map[string]interface{}{})
+		return
+	case parts[0] == "schemas":
+		s.write(rw, s.schemaCollection())
+		return
+	}
+
+	kind := KindAPI
+	if parts[0] == "publishes" {
+		kind = KindPublish
+	}
+	s.recorder.Add(Record{
+		Kind:   kind,
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+		Body:   rawJSON(body),
+	})
+
+	schemaType, ok := schemas[parts[0]]
+	if !ok {
+		http.Error(rw, "unknown resource type "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		s.write(rw, s.list(schemaType, req))
+	case len(parts) == 1 && req.Method == http.MethodPost:
+		resource := map[string]interface{}{}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &resource); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		resource["id"] = s.newID()
+		s.resources[schemaType][resource["id"].(string)] = resource
+		s.write(rw, s.decorate(schemaType, resource))
+	case len(parts) >= 2:
+		s.serveResource(rw, req, schemaType, parts, body)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Stub) serveResource(rw http.ResponseWriter, req *http.Request, schemaType string, parts []string, body []byte) {
+	resource, ok := s.resources[schemaType][parts[1]]
+	if !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "secretValues":
+		secretValues, _ := resource["secretValues"].(map[string]interface{})
+		if secretValues == nil {
+			secretValues = map[string]interface{}{}
+		}
+		s.write(rw, secretValues)
+	case req.Method == http.MethodGet:
+		s.write(rw, s.decorate(schemaType, resource))
+	case req.Method == http.MethodPut:
+		updates := map[string]interface{}{}
+		if err := json.Unmarshal(body, &updates); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mergeData(resource, updates)
+		for k, v := range updates {
+			if k != "data" {
+				resource[k] = v
+			}
+		}
+		s.write(rw, s.decorate(schemaType, resource))
+	case req.Method == http.MethodPost && req.URL.Query().Get("action") != "":
+		s.write(rw, s.decorate(schemaType, resource))
+	case req.Method == http.MethodDelete:
+		delete(s.resources[schemaType], parts[1])
+		s.write(rw, s.decorate(schemaType, resource))
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mergeData sets the keys of the data of the updates in the data of the
+// resource, keeping its other keys, as the keys of data are updated one by one.
+func mergeData(resource, updates map[string]interface{}) {
+	data, ok := updates["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	merged := map[string]interface{}{}
+	if current, ok := resource["data"].(map[string]interface{}); ok {
+		for k, v := range current {
+			merged[k] = v
+		}
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+	resource["data"] = merged
+}
+
+// list returns the resources matching the filters of the request. Only
+// equality, _ne and _null filters are supported, other parameters are ignored.
+func (s *Stub) list(schemaType string, req *http.Request) map[string]interface{} {
+	data := []interface{}{}
+	for _, resource := range s.resources[schemaType] {
+		if matches(resource, req.URL.Query()) {
+			data = append(data, s.decorate(schemaType, resource))
+		}
+	}
+	return map[string]interface{}{
+		"type":         "collection",
+		"resourceType": schemaType,
+		"data":         data,
+	}
+}
+
+func matches(resource map[string]interface{}, filters map[string][]string) bool {
+	for key, values := range filters {
+		value := ""
+		if len(values) > 0 {
+			value = values[0]
+		}
+		switch {
+		case strings.HasSuffix(key, "_null"):
+			if resource[strings.TrimSuffix(key, "_null")] != nil {
+				return false
+			}
+		case strings.HasSuffix(key, "_ne"):
+			if fmt.Sprint(resource[strings.TrimSuffix(key, "_ne")]) == value {
+				return false
+			}
+		case strings.Contains(key, "_"):
+		default:
+			if v, ok := resource[key]; ok && fmt.Sprint(v) != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decorate adds the type, links and actions the client needs to the resource.
+func (s *Stub) decorate(schemaType string, resource map[string]interface{}) map[string]interface{} {
+	self := s.URL() + "/" + pluralName(schemaType) + "/" + fmt.Sprint(resource["id"])
+	decorated := map[string]interface{}{}
+	for k, v := range resource {
+		decorated[k] = v
+	}
+	decorated["type"] = schemaType
+	decorated["links"] = map[string]string{
+		"self":         self,
+		"secretValues": self + "/secretValues",
+	}
+	resourceActions := map[string]string{}
+	for _, action := range actions {
+		resourceActions[action] = self + "?action=" + action
+	}
+	decorated["actions"] = resourceActions
+	return decorated
+}
+
+func (s *Stub) schemaCollection() client.Schemas {
+	collection := client.Schemas{}
+	for plural, schemaType := range schemas {
+		schema := client.Schema{
+			PluralName:        plural,
+			CollectionMethods: []string{"GET", "POST"},
+			ResourceMethods:   []string{"GET", "PUT", "DELETE"},
+		}
+		schema.Id = schemaType
+		schema.Type = "schema"
+		schema.Links = map[string]string{
+			"self":       s.URL() + "/schemas/" + schemaType,
+			"collection": s.URL() + "/" + plural,
+		}
+		collection.Data = append(collection.Data, schema)
+	}
+	return collection
+}
+
+func (s *Stub) write(rw http.ResponseWriter, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(obj)
+}
+
+func pluralName(schemaType string) string {
+	for plural, t := range schemas {
+		if t == schemaType {
+			return plural
+		}
+	}
+	return strings.ToLower(schemaType) + "s"
+}
+
+func rawJSON(body []byte) json.RawMessage {
+	var v interface{}
+	if len(body) == 0 || json.Unmarshal(body, &v) != nil {
+		return nil
+	}
+	return json.RawMessage(body)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rancher/go-machine-service/dynamic"
+	"github.com/rancher/go-machine-service/logging"
+	"github.com/rancher/go-machine-service/metrics"
+)
+
+var logger = logging.Logger()
+
+type RouterStatus struct {
+	ResourceName string `json:"resourceName"`
+	Subscribed   bool   `json:"subscribed"`
+}
+
+type Status struct {
+	Ready      bool                   `json:"ready"`
+	Routers    []RouterStatus         `json:"routers"`
+	Drivers    []dynamic.DriverStatus `json:"drivers"`
+	DriversErr string                 `json:"driversError,omitempty"`
+	Running    map[string]int         `json:"running"`
+	Provisions int                    `json:"provisions"`
+}
+
+// Server serves the endpoints of the service: the health, readiness and
+// metrics ones, probed from outside, and the status and provisioning log ones,
+// which may expose more than they should and are served apart.
+type Server struct {
+	ready int32
+
+	Routers func() []RouterStatus
+	Drivers func() ([]dynamic.DriverStatus, error)
+	Running func() map[string]int
+	// ProvisionLog writes the provisioning log of a host, or returns an error
+	// satisfying os.IsNotExist if there is none.
+	ProvisionLog func(hostID string, w io.Writer) error
+}
+
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// ProbeHandler serves the health, readiness and metrics endpoints.
+func (s *Server) ProbeHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// Handler serves the status and provisioning log endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.status)
+	mux.HandleFunc("/hosts/", s.provisionLog)
+	return mux
+}
+
+func ListenAndServe(addr string, handler http.Handler) error {
+	logger.Infof("Listening on %s", addr)
+	return http.ListenAndServe(addr, handler)
+}
+
+func (s *Server) healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Write([]byte("ok"))
+}
+
+func (s *Server) readyz(rw http.ResponseWriter, req *http.Request) {
+	if !s.Ready() {
+		http.Error(rw, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+func (s *Server) status(rw http.ResponseWriter, req *http.Request) {
+	status := Status{
+		Ready:   s.Ready(),
+		Routers: []RouterStatus{},
+		Drivers: []dynamic.DriverStatus{},
+		Running: map[string]int{},
+	}
+	if s.Routers != nil {
+		status.Routers = s.Routers()
+	}
+	if s.Drivers != nil {
+		drivers, err := s.Drivers()
+		if err != nil {
+			status.DriversErr = err.Error()
+		} else {
+			status.Drivers = drivers
+		}
+	}
+	if s.Running != nil {
+		status.Running = s.Running()
+	}
+	status.Provisions = status.Running["host.provision"]
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		logger.Errorf("Failed to write status: %v", err)
+	}
+}
+
+// provisionLog serves /hosts/<id>/log, the provisioning log of the host.
+func (s *Server) provisionLog(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/hosts/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "log" || s.ProvisionLog == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := s.ProvisionLog(parts[0], rw); os.IsNotExist(err) {
+		http.NotFound(rw, req)
+	} else if err != nil {
+		logger.Errorf("Failed to write provisioning log of host %s: %v", parts[0], err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
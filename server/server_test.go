@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/rancher/go-machine-service/dynamic"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, path string) *http.Request {
+	req, err := http.NewRequest("GET", path, nil)
+	require.Nil(t, err)
+	return req
+}
+
+func TestReadyz(t *testing.T) {
+	assert := require.New(t)
+	s := &Server{}
+
+	rec := httptest.NewRecorder()
+	s.ProbeHandler().ServeHTTP(rec, get(t, "/readyz"))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	s.SetReady(true)
+	rec = httptest.NewRecorder()
+	s.ProbeHandler().ServeHTTP(rec, get(t, "/readyz"))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ProbeHandler().ServeHTTP(rec, get(t, "/healthz"))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// The status is not served along with the probes
+	rec = httptest.NewRecorder()
+	s.ProbeHandler().ServeHTTP(rec, get(t, "/status"))
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestStatus(t *testing.T) {
+	assert := require.New(t)
+	s := &Server{
+		Routers: func() []RouterStatus {
+			return []RouterStatus{{ResourceName: "host", Subscribed: true}}
+		},
+		Drivers: func() ([]dynamic.DriverStatus, error) {
+			return []dynamic.DriverStatus{{Name: "packet", State: "active", Error: "Hash does not match"}}, nil
+		},
+		Running: func() map[string]int {
+			return map[string]int{"host.provision": 2, "host.remove": 1}
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, get(t, "/status"))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	status := Status{}
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.False(status.Ready)
+	assert.Equal("host", status.Routers[0].ResourceName)
+	assert.Equal("Hash does not match", status.Drivers[0].Error)
+	assert.Equal(2, status.Provisions)
+}
+
+func TestProvisionLog(t *testing.T) {
+	assert := require.New(t)
+	s := &Server{
+		ProvisionLog: func(hostID string, w io.Writer) error {
+			if hostID != "1h1" {
+				return os.ErrNotExist
+			}
+			_, err := io.WriteString(w, "stdout Creating machine...\n")
+			return err
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, get(t, "/hosts/1h1/log"))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("stdout Creating machine...\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, get(t, "/hosts/1h2/log"))
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, get(t, "/hosts/1h1"))
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	serviceName   = "go-machine-service"
+	batchSize     = 100
+	flushInterval = 5 * time.Second
+	queueSize     = 2048
+)
+
+// batcher queues spans and sends them in batches from a single goroutine.
+// Spans are dropped when the queue is full, so that tracing never blocks
+// event handling, and once the batcher is shut down.
+type batcher struct {
+	sync.Mutex
+	queue  chan *Span
+	done   chan struct{}
+	closed bool
+	send   func(spans []*Span) error
+}
+
+func newBatcher(send func(spans []*Span) error) *batcher {
+	b := &batcher{
+		queue: make(chan *Span, queueSize),
+		done:  make(chan struct{}),
+		send:  send,
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) Export(span *Span) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- span:
+	default:
+		logger.Warnf("Trace queue is full, dropping span %s", span.Name)
+	}
+}
+
+func (b *batcher) Shutdown() {
+	b.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.Unlock()
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	spans := []*Span{}
+	flush := func() {
+		if len(spans) == 0 {
+			return
+		}
+		if err := b.send(spans); err != nil {
+			logger.Errorf("Failed to export %d spans: %v", len(spans), err)
+		}
+		spans = []*Span{}
+	}
+
+	for {
+		select {
+		case span, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			spans = append(spans, span)
+			if len(spans) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// NewFileExporter writes spans as JSON lines to the file.
+func NewFileExporter(file string) (Exporter, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{
+		batcher: newBatcher(func(spans []*Span) error {
+			return writeSpans(f, spans)
+		}),
+		file: f,
+	}, nil
+}
+
+type fileExporter struct {
+	*batcher
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown() {
+	e.batcher.Shutdown()
+	e.file.Close()
+}
+
+func writeSpans(w io.Writer, spans []*Span) error {
+	encoder := json.NewEncoder(w)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewOTLPExporter sends spans to an OTLP/HTTP endpoint using the JSON encoding,
+// such as http://otel-collector:4318/v1/traces.
+func NewOTLPExporter(endpoint string) Exporter {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return newBatcher(func(spans []*Span) error {
+		content, err := json.Marshal(otlpRequest(spans))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+		}
+		return nil
+	})
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	kvs := []otlpKeyValue{}
+	for k, v := range attributes {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func otlpRequest(spans []*Span) map[string]interface{} {
+	otlpSpans := []otlpSpan{}
+	for _, span := range spans {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		span.mu.Unlock()
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": serviceName},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
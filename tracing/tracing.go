@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-machine-service/config"
+	"github.com/rancher/go-machine-service/logging"
+)
+
+var logger = logging.Logger()
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	Export(span *Span)
+	Shutdown()
+}
+
+var (
+	lock     sync.RWMutex
+	exporter Exporter
+)
+
+// SetExporter sets the exporter of the spans started from now on, nil disables tracing.
+func SetExporter(e Exporter) {
+	lock.Lock()
+	defer lock.Unlock()
+	exporter = e
+}
+
+// Shutdown flushes the spans not exported yet and disables tracing.
+func Shutdown() {
+	lock.Lock()
+	e := exporter
+	exporter = nil
+	lock.Unlock()
+
+	if e != nil {
+		e.Shutdown()
+	}
+}
+
+// Span is a timed step of the work done for an event. All methods may be
+// called on a nil span, which is what Start returns when tracing is disabled.
+type Span struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	mu       sync.Mutex
+	exporter Exporter
+}
+
+// Start starts a root span, or returns nil if tracing is disabled.
+func Start(name string) *Span {
+	lock.RLock()
+	e := exporter
+	lock.RUnlock()
+	if e == nil {
+		return nil
+	}
+
+	return &Span{
+		TraceID:  newID(16),
+		SpanID:   newID(8),
+		Name:     name,
+		Start:    time.Now(),
+		exporter: e,
+	}
+}
+
+// Child starts a span for a step of the span.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		TraceID:  s.TraceID,
+		SpanID:   newID(8),
+		ParentID: s.SpanID,
+		Name:     name,
+		Start:    time.Now(),
+		exporter: s.exporter,
+	}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, recording the error if any, and exports it.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.mu.Unlock()
+	s.exporter.Export(s)
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Configure sets the exporter from the configuration.
+func Configure(c config.Tracing) error {
+	switch c.Exporter {
+	case "":
+		SetExporter(nil)
+	case config.TracingExporterFile:
+		e, err := NewFileExporter(c.File)
+		if err != nil {
+			return err
+		}
+		SetExporter(e)
+	case config.TracingExporterOTLP:
+		SetExporter(NewOTLPExporter(c.Endpoint))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisabled(t *testing.T) {
+	assert := require.New(t)
+
+	SetExporter(nil)
+	span := Start("host.provision")
+	assert.Nil(span)
+
+	// A nil span must be usable
+	child := span.Child("pullImage")
+	child.SetAttribute("image", "rancher/agent")
+	child.Finish(nil)
+	span.Finish(nil)
+}
+
+func TestFileExporter(t *testing.T) {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "gms-spans")
+	assert.Nil(err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	exporter, err := NewFileExporter(f.Name())
+	assert.Nil(err)
+	SetExporter(exporter)
+
+	span := Start("host.provision")
+	child := span.Child("pullImage")
+	child.SetAttribute("image", "rancher/agent")
+	child.Finish(errors.New("pull failed"))
+	span.Finish(nil)
+	Shutdown()
+
+	out, err := os.Open(f.Name())
+	assert.Nil(err)
+	defer out.Close()
+
+	spans := []*Span{}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		s := &Span{}
+		assert.Nil(json.Unmarshal(scanner.Bytes(), s))
+		spans = append(spans, s)
+	}
+	assert.Len(spans, 2)
+	assert.Equal("pullImage", spans[0].Name)
+	assert.Equal(spans[1].SpanID, spans[0].ParentID)
+	assert.Equal(spans[1].TraceID, spans[0].TraceID)
+	assert.Equal("pull failed", spans[0].Error)
+	assert.Equal("rancher/agent", spans[0].Attributes["image"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := require.New(t)
+
+	requests := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	SetExporter(NewOTLPExporter(server.URL + "/v1/traces"))
+	Start("host.remove").Finish(errors.New("failed"))
+	Shutdown()
+
+	body := <-requests
+	resourceSpans := body["resourceSpans"].([]interface{})
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Len(spans, 1)
+	span := spans[0].(map[string]interface{})
+	assert.Equal("host.remove", span["name"])
+	assert.Len(span["traceId"], 32)
+	assert.Equal(float64(otlpStatusError), span["status"].(map[string]interface{})["code"])
+}
+
+func TestBatcherShutdown(t *testing.T) {
+	assert := require.New(t)
+
+	sent := 0
+	b := newBatcher(func(spans []*Span) error {
+		sent += len(spans)
+		return nil
+	})
+	b.Export(&Span{Name: "host.provision"})
+	b.Shutdown()
+	b.Export(&Span{Name: "host.remove"})
+	b.Shutdown()
+	assert.Equal(1, sent)
+}